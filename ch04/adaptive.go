@@ -0,0 +1,288 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrLimitExceeded is returned by an adaptively limited effector when the
+// number of calls in flight has reached the current limit.
+var ErrLimitExceeded = errors.New("concurrency limit exceeded")
+
+// LimitSample describes the outcome of one call, for a LimitAlgorithm.
+type LimitSample struct {
+	RTT      time.Duration // How long the call took
+	InFlight int           // Calls in flight when it started, including itself
+	Dropped  bool          // Whether it failed in a way that signals overload
+}
+
+// LimitAlgorithm computes a new concurrency limit from the current limit
+// and the outcome of a call. An AdaptiveLimiter calls Update under its
+// lock, so implementations needn't be safe for concurrent use.
+type LimitAlgorithm interface {
+	Update(limit int, sample LimitSample) int
+}
+
+// AIMD is a LimitAlgorithm that increases the limit by one after each
+// successful call that was made while the limit was being used, and
+// multiplies it by Backoff after each dropped call.
+type AIMD struct {
+	// Backoff is the factor the limit is multiplied by on a drop.
+	// Defaults to 0.9.
+	Backoff float64
+}
+
+func (a *AIMD) Update(limit int, s LimitSample) int {
+	backoff := a.Backoff
+	if backoff <= 0 || backoff >= 1 {
+		backoff = 0.9
+	}
+
+	switch {
+	case s.Dropped:
+		return int(float64(limit) * backoff)
+	case s.InFlight*2 >= limit: // Don't grow a limit that isn't being used
+		return limit + 1
+	default:
+		return limit
+	}
+}
+
+// Vegas is a LimitAlgorithm modelled on TCP Vegas. It estimates the
+// number of calls queued at the dependency from how far the RTT of each
+// call exceeds the lowest RTT seen, and grows the limit while that queue
+// is short and shrinks it once the queue grows.
+type Vegas struct {
+	minRTT time.Duration
+}
+
+func (v *Vegas) Update(limit int, s LimitSample) int {
+	if s.RTT <= 0 {
+		return limit
+	}
+
+	if v.minRTT == 0 || s.RTT < v.minRTT {
+		v.minRTT = s.RTT
+	}
+
+	l := float64(limit)
+	step := max(math.Log10(l), 1)
+	alpha, beta := 3*step, 6*step
+
+	queue := l * (1 - float64(v.minRTT)/float64(s.RTT))
+
+	switch {
+	case s.Dropped:
+		l -= step
+	case queue < alpha && s.InFlight*2 >= limit:
+		l += step
+	case queue > beta:
+		l -= step
+	}
+
+	return int(math.Round(l))
+}
+
+// Gradient is a LimitAlgorithm that compares the RTT of each call with a
+// long-term average RTT. While they agree the limit grows by about
+// Smoothing times its square root per call; as calls slow down it
+// shrinks, by up to half at a time.
+type Gradient struct {
+	// Tolerance is how much slower than the long-term average a call may
+	// be before the limit shrinks. Defaults to 1.5.
+	Tolerance float64
+
+	// Smoothing is the weight given to each new limit. Defaults to 0.2.
+	Smoothing float64
+
+	longRTT float64 // Exponentially weighted moving average, in ns
+}
+
+func (g *Gradient) Update(limit int, s LimitSample) int {
+	if s.RTT <= 0 {
+		return limit
+	}
+
+	tolerance, smoothing := g.Tolerance, g.Smoothing
+	if tolerance < 1 {
+		tolerance = 1.5
+	}
+	if smoothing <= 0 || smoothing > 1 {
+		smoothing = 0.2
+	}
+
+	rtt := float64(s.RTT)
+	if g.longRTT == 0 {
+		g.longRTT = rtt
+	} else {
+		g.longRTT = g.longRTT*0.99 + rtt*0.01
+	}
+
+	l := float64(limit)
+	if s.Dropped {
+		return int(l * 0.5)
+	}
+
+	if s.InFlight*2 < limit {
+		return limit // Don't grow a limit that isn't being used
+	}
+
+	gradient := max(0.5, min(1, tolerance*g.longRTT/rtt))
+	target := l*gradient + math.Sqrt(l)
+
+	return int(math.Round(l*(1-smoothing) + target*smoothing))
+}
+
+// AdaptiveLimiterOptions configures an AdaptiveLimiter.
+type AdaptiveLimiterOptions struct {
+	// Algorithm adjusts the limit after each call. Defaults to &AIMD{}.
+	Algorithm LimitAlgorithm
+
+	// InitialLimit is the limit to start with. Defaults to 10.
+	InitialLimit int
+
+	// MinLimit and MaxLimit bound the limit. They default to 1 and 1000.
+	MinLimit int
+	MaxLimit int
+
+	// IsDropped reports whether an error signals that the dependency is
+	// overloaded. Defaults to err != nil.
+	IsDropped func(err error) bool
+
+	// Clock is used to measure RTTs. Defaults to the system clock.
+	Clock Clock
+}
+
+// AdaptiveLimiter caps the number of concurrent calls to the effectors
+// that share it, like a Bulkhead, but adjusts the cap as it goes, based
+// on the latency and errors of the calls it lets through. An
+// AdaptiveLimiter is safe for concurrent use.
+type AdaptiveLimiter struct {
+	opts AdaptiveLimiterOptions
+
+	m        sync.Mutex
+	limit    int
+	inFlight int
+}
+
+// NewAdaptiveLimiter returns an AdaptiveLimiter configured by opts.
+func NewAdaptiveLimiter(opts AdaptiveLimiterOptions) *AdaptiveLimiter {
+	if opts.Algorithm == nil {
+		opts.Algorithm = &AIMD{}
+	}
+	if opts.MinLimit <= 0 {
+		opts.MinLimit = 1
+	}
+	if opts.MaxLimit <= 0 {
+		opts.MaxLimit = 1000
+	}
+	if opts.InitialLimit <= 0 {
+		opts.InitialLimit = 10
+	}
+	if opts.IsDropped == nil {
+		opts.IsDropped = func(err error) bool { return err != nil }
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+
+	return &AdaptiveLimiter{
+		opts:  opts,
+		limit: min(max(opts.InitialLimit, opts.MinLimit), opts.MaxLimit),
+	}
+}
+
+// Limit returns the current concurrency limit.
+func (l *AdaptiveLimiter) Limit() int {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.limit
+}
+
+// InFlight returns the number of calls currently in flight.
+func (l *AdaptiveLimiter) InFlight() int {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.inFlight
+}
+
+// Acquire takes a slot if fewer than Limit calls are in flight. On success
+// the caller must call release with the call's error when it's done, so
+// that the limit can be adjusted.
+func (l *AdaptiveLimiter) Acquire() (release func(err error), ok bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.inFlight >= l.limit {
+		return nil, false
+	}
+
+	l.inFlight++
+	inFlight := l.inFlight
+	start := l.opts.Clock.Now()
+
+	return func(err error) {
+		sample := LimitSample{
+			RTT:      l.opts.Clock.Now().Sub(start),
+			InFlight: inFlight,
+			Dropped:  l.opts.IsDropped(err),
+		}
+
+		l.m.Lock()
+		defer l.m.Unlock()
+
+		l.inFlight--
+		limit := l.opts.Algorithm.Update(l.limit, sample)
+		l.limit = min(max(limit, l.opts.MinLimit), l.opts.MaxLimit)
+	}, true
+}
+
+// AdaptiveLimitWith returns an Effector that calls e only if l has a slot
+// free, and fails with ErrLimitExceeded otherwise.
+func AdaptiveLimitWith(l *AdaptiveLimiter, e Effector) Effector {
+	return AdaptiveLimitWithOf(l, e)
+}
+
+// AdaptiveLimitWithOf is the generic form of AdaptiveLimitWith.
+func AdaptiveLimitWithOf[T any](l *AdaptiveLimiter, e EffectorOf[T]) EffectorOf[T] {
+	return func(ctx context.Context) (T, error) {
+		release, ok := l.Acquire()
+		if !ok {
+			var zero T
+			return zero, ErrLimitExceeded
+		}
+
+		// A panicking effector still frees its slot, and counts as a drop.
+		panicked := true
+		defer func() {
+			if panicked {
+				release(ErrPanicked)
+			}
+		}()
+
+		res, err := e(ctx)
+		panicked = false
+		release(err)
+
+		return res, err
+	}
+}
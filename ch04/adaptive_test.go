@@ -0,0 +1,197 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// saturate fills every slot in l, advances clock by rtt, and releases the
+// slots with err. It returns the new limit.
+func saturate(l *AdaptiveLimiter, clock *fakeClock, rtt time.Duration, err error) int {
+	var releases []func(error)
+
+	for {
+		release, ok := l.Acquire()
+		if !ok {
+			break
+		}
+		releases = append(releases, release)
+	}
+
+	clock.advance(rtt)
+
+	for _, release := range releases {
+		release(err)
+	}
+
+	return l.Limit()
+}
+
+// TestAdaptiveLimiterRejects tests that calls beyond the current limit
+// are rejected.
+func TestAdaptiveLimiterRejects(t *testing.T) {
+	l := NewAdaptiveLimiter(AdaptiveLimiterOptions{InitialLimit: 1, Clock: newFakeClock()})
+
+	release, ok := l.Acquire()
+	if !ok {
+		t.Fatal("expected first call to be admitted")
+	}
+
+	e := AdaptiveLimitWith(l, countingEffector(new(int), nil))
+	if _, err := e(context.Background()); !errors.Is(err, ErrLimitExceeded) {
+		t.Error("expected ErrLimitExceeded; got", err)
+	}
+
+	release(nil)
+
+	if l.InFlight() != 0 {
+		t.Error("expected nothing in flight; got", l.InFlight())
+	}
+}
+
+// TestAdaptiveLimiterPanic tests that a panicking effector frees its slot
+// and counts as a drop.
+func TestAdaptiveLimiterPanic(t *testing.T) {
+	l := NewAdaptiveLimiter(AdaptiveLimiterOptions{
+		InitialLimit: 10,
+		Algorithm:    &AIMD{},
+		Clock:        newFakeClock(),
+	})
+
+	e := AdaptiveLimitWith(l, func(ctx context.Context) (string, error) {
+		panic("INTENTIONAL PANIC!")
+	})
+
+	func() {
+		defer func() { recover() }()
+		e(context.Background())
+	}()
+
+	if l.InFlight() != 0 {
+		t.Error("expected nothing in flight; got", l.InFlight())
+	}
+
+	if l.Limit() >= 10 {
+		t.Error("expected limit to shrink; got", l.Limit())
+	}
+}
+
+// TestAdaptiveLimiterAIMD tests that AIMD grows the limit additively
+// under load and shrinks it multiplicatively on drops.
+func TestAdaptiveLimiterAIMD(t *testing.T) {
+	clock := newFakeClock()
+	l := NewAdaptiveLimiter(AdaptiveLimiterOptions{
+		Algorithm:    &AIMD{Backoff: 0.5},
+		InitialLimit: 4,
+		Clock:        clock,
+	})
+
+	// Each successful call that started with at least half the limit in
+	// flight, the last 3 of 4, adds one to the limit.
+	if limit := saturate(l, clock, 10*time.Millisecond, nil); limit != 7 {
+		t.Error("expected 7; got", limit)
+	}
+
+	// Each of the 7 drops halves the limit, down to the minimum.
+	if limit := saturate(l, clock, 10*time.Millisecond, errors.New("overloaded")); limit != 1 {
+		t.Error("expected 1; got", limit)
+	}
+
+	// A lone call on an idle limiter doesn't grow a limit it isn't using.
+	l = NewAdaptiveLimiter(AdaptiveLimiterOptions{InitialLimit: 10, Clock: clock})
+	release, _ := l.Acquire()
+	release(nil)
+
+	if limit := l.Limit(); limit != 10 {
+		t.Error("expected idle limit to stay at 10; got", limit)
+	}
+}
+
+// TestAdaptiveLimiterVegas tests that Vegas grows the limit while latency
+// is steady and shrinks it once latency rises.
+func TestAdaptiveLimiterVegas(t *testing.T) {
+	clock := newFakeClock()
+	l := NewAdaptiveLimiter(AdaptiveLimiterOptions{
+		Algorithm:    &Vegas{},
+		InitialLimit: 10,
+		Clock:        clock,
+	})
+
+	limit := 10
+	for i := 0; i < 5; i++ {
+		next := saturate(l, clock, 10*time.Millisecond, nil)
+		if next <= limit {
+			t.Fatalf("round %d: expected limit to grow past %d; got %d", i, limit, next)
+		}
+		limit = next
+	}
+
+	// Doubling the RTT implies half the calls are queued.
+	next := saturate(l, clock, 20*time.Millisecond, nil)
+	if next >= limit {
+		t.Errorf("expected limit to shrink from %d; got %d", limit, next)
+	}
+}
+
+// TestAdaptiveLimiterGradient tests that Gradient grows the limit while
+// latency is steady and shrinks it once latency rises.
+func TestAdaptiveLimiterGradient(t *testing.T) {
+	clock := newFakeClock()
+	l := NewAdaptiveLimiter(AdaptiveLimiterOptions{
+		Algorithm:    &Gradient{},
+		InitialLimit: 10,
+		Clock:        clock,
+	})
+
+	limit := 10
+	for i := 0; i < 3; i++ {
+		next := saturate(l, clock, 10*time.Millisecond, nil)
+		if next <= limit {
+			t.Fatalf("round %d: expected limit to grow past %d; got %d", i, limit, next)
+		}
+		limit = next
+	}
+
+	next := saturate(l, clock, 100*time.Millisecond, nil)
+	if next >= limit {
+		t.Errorf("expected limit to shrink from %d; got %d", limit, next)
+	}
+}
+
+// TestAdaptiveLimiterBounds tests that the limit stays within MinLimit
+// and MaxLimit.
+func TestAdaptiveLimiterBounds(t *testing.T) {
+	clock := newFakeClock()
+	l := NewAdaptiveLimiter(AdaptiveLimiterOptions{
+		InitialLimit: 5,
+		MinLimit:     3,
+		MaxLimit:     6,
+		Clock:        clock,
+	})
+
+	if limit := saturate(l, clock, time.Millisecond, nil); limit != 6 {
+		t.Error("expected limit capped at 6; got", limit)
+	}
+
+	if limit := saturate(l, clock, time.Millisecond, errors.New("overloaded")); limit != 3 {
+		t.Error("expected limit floored at 3; got", limit)
+	}
+}
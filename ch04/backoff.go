@@ -0,0 +1,107 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff computes how long to wait before a retry. The attempt argument
+// is 1 before the first retry, 2 before the second, and so on; prev is the
+// delay that the Backoff returned for the previous retry, or zero.
+//
+// See https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+// for a comparison of the jittered strategies.
+type Backoff func(attempt int, prev time.Duration) time.Duration
+
+// ConstantBackoff returns a Backoff that always waits d.
+func ConstantBackoff(d time.Duration) Backoff {
+	return func(int, time.Duration) time.Duration {
+		return d
+	}
+}
+
+// ExponentialBackoff returns a Backoff that waits base before the first
+// retry, doubling before each retry after that, to a maximum of max.
+func ExponentialBackoff(base, max time.Duration) Backoff {
+	return func(attempt int, _ time.Duration) time.Duration {
+		return exponential(base, max, attempt)
+	}
+}
+
+// FullJitterBackoff returns a Backoff that waits a random duration between
+// zero and the delay that ExponentialBackoff would return.
+func FullJitterBackoff(base, max time.Duration) Backoff {
+	return func(attempt int, _ time.Duration) time.Duration {
+		return randomDuration(exponential(base, max, attempt))
+	}
+}
+
+// EqualJitterBackoff returns a Backoff that waits half the delay that
+// ExponentialBackoff would return, plus a random duration up to the other
+// half.
+func EqualJitterBackoff(base, max time.Duration) Backoff {
+	return func(attempt int, _ time.Duration) time.Duration {
+		d := exponential(base, max, attempt) / 2
+		return d + randomDuration(d)
+	}
+}
+
+// DecorrelatedJitterBackoff returns a Backoff that waits a random duration
+// between base and three times its previous delay, to a maximum of max.
+func DecorrelatedJitterBackoff(base, max time.Duration) Backoff {
+	return func(_ int, prev time.Duration) time.Duration {
+		if prev < base {
+			prev = base
+		}
+
+		d := base + randomDuration(prev*3-base)
+		if d > max || d < base { // d < base on overflow
+			d = max
+		}
+
+		return d
+	}
+}
+
+// exponential returns base * 2^(attempt-1), capped at max.
+func exponential(base, max time.Duration, attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	if attempt > 62 {
+		return max
+	}
+
+	d := base << (attempt - 1)
+	if d > max || d < base { // d < base on overflow
+		d = max
+	}
+
+	return d
+}
+
+// randomDuration returns a random duration in [0, d).
+func randomDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int64N(int64(d)))
+}
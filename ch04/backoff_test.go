@@ -0,0 +1,105 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBackoffConstant tests that ConstantBackoff never changes.
+func TestBackoffConstant(t *testing.T) {
+	b := ConstantBackoff(time.Second)
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		if d := b(attempt, time.Second); d != time.Second {
+			t.Errorf("attempt %d: expected 1s; got %v", attempt, d)
+		}
+	}
+}
+
+// TestBackoffExponential tests that ExponentialBackoff doubles until it
+// reaches its maximum, and doesn't overflow.
+func TestBackoffExponential(t *testing.T) {
+	b := ExponentialBackoff(time.Second, time.Minute)
+	expected := []time.Duration{1, 2, 4, 8, 16, 32, 60, 60}
+
+	for i, e := range expected {
+		if d := b(i+1, 0); d != e*time.Second {
+			t.Errorf("attempt %d: expected %v; got %v", i+1, e*time.Second, d)
+		}
+	}
+
+	if d := b(1000, 0); d != time.Minute {
+		t.Error("expected maximum for large attempt; got", d)
+	}
+}
+
+// TestBackoffJitterBounds tests that the jittered strategies stay within
+// their documented bounds.
+func TestBackoffJitterBounds(t *testing.T) {
+	const base, max = time.Second, time.Minute
+
+	tests := []struct {
+		name     string
+		backoff  Backoff
+		min, max func(attempt int, prev time.Duration) time.Duration
+	}{
+		{
+			name:    "full",
+			backoff: FullJitterBackoff(base, max),
+			min:     func(int, time.Duration) time.Duration { return 0 },
+			max:     func(a int, _ time.Duration) time.Duration { return exponential(base, max, a) },
+		},
+		{
+			name:    "equal",
+			backoff: EqualJitterBackoff(base, max),
+			min:     func(a int, _ time.Duration) time.Duration { return exponential(base, max, a) / 2 },
+			max:     func(a int, _ time.Duration) time.Duration { return exponential(base, max, a) },
+		},
+		{
+			name:    "decorrelated",
+			backoff: DecorrelatedJitterBackoff(base, max),
+			min:     func(int, time.Duration) time.Duration { return base },
+			max: func(_ int, prev time.Duration) time.Duration {
+				if prev < base {
+					prev = base
+				}
+				return min(3*prev, max)
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				var prev time.Duration
+
+				for attempt := 1; attempt <= 10; attempt++ {
+					d := tc.backoff(attempt, prev)
+					lo, hi := tc.min(attempt, prev), tc.max(attempt, prev)
+
+					if d < lo || d > hi {
+						t.Fatalf("attempt %d: %v not in [%v, %v]", attempt, d, lo, hi)
+					}
+
+					prev = d
+				}
+			}
+		})
+	}
+}
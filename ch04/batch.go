@@ -0,0 +1,91 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"time"
+)
+
+// Batch returns a channel that receives the values from source in slices
+// of up to size values. A batch is sent once it's full, or once maxWait has
+// passed since its first value was received, whichever is first. A size
+// or maxWait of zero or less disables that bound. Any partial batch is sent
+// once source is closed, and then the channel is closed; it's also closed
+// once ctx is done, in which case the partial batch is dropped.
+func Batch[T any](ctx context.Context, source <-chan T, size int, maxWait time.Duration) <-chan []T {
+	dest := make(chan []T)
+
+	go func() {
+		defer close(dest)
+
+		var batch []T
+		var timer *time.Timer
+		var timeout <-chan time.Time
+
+		flush := func() bool {
+			if timer != nil {
+				timer.Stop()
+				timeout = nil
+			}
+
+			b := batch
+			batch = nil
+
+			return send(ctx, dest, b)
+		}
+
+		for {
+			select {
+			case v, ok := <-source:
+				if !ok {
+					if len(batch) > 0 {
+						flush()
+					}
+					return
+				}
+
+				batch = append(batch, v)
+
+				switch {
+				case size > 0 && len(batch) >= size:
+					if !flush() {
+						return
+					}
+
+				case len(batch) == 1 && maxWait > 0:
+					if timer == nil {
+						timer = time.NewTimer(maxWait)
+					} else {
+						timer.Reset(maxWait)
+					}
+					timeout = timer.C
+				}
+
+			case <-timeout:
+				if !flush() {
+					return
+				}
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return dest
+}
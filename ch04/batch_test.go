@@ -0,0 +1,85 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestBatchSize tests that Batch sends full batches, and then the partial
+// batch once its source is closed.
+func TestBatchSize(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	var got [][]int
+	for b := range Batch(context.Background(), generate(1, 2, 3, 4, 5), 2, 0) {
+		got = append(got, b)
+	}
+
+	expected := [][]int{{1, 2}, {3, 4}, {5}}
+	if !slices.EqualFunc(got, expected, slices.Equal) {
+		t.Error("expected", expected, "; got", got)
+	}
+}
+
+// TestBatchMaxWait tests that Batch sends a partial batch once maxWait has
+// passed since its first value.
+func TestBatchMaxWait(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	source := make(chan int)
+	batches := Batch(context.Background(), source, 10, 50*time.Millisecond)
+
+	start := time.Now()
+	source <- 1
+	source <- 2
+
+	b := <-batches
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Error("expected to wait for maxWait; took", elapsed)
+	}
+
+	if !slices.Equal(b, []int{1, 2}) {
+		t.Error("expected [1 2]; got", b)
+	}
+
+	close(source)
+
+	if _, ok := <-batches; ok {
+		t.Error("expected no more batches")
+	}
+}
+
+// TestBatchCancel tests that Batch stops, without leaking goroutines, when
+// its context is done.
+func TestBatchCancel(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	source := make(chan int)
+	batches := Batch(ctx, source, 10, time.Minute)
+
+	source <- 1
+	cancel()
+
+	if _, ok := <-batches; ok {
+		t.Error("expected partial batch to be dropped")
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrBulkheadFull is matched, using errors.Is, by the errors returned when
+// a Bulkhead rejects a call.
+var ErrBulkheadFull = errors.New("bulkhead full")
+
+// BulkheadError is returned when a Bulkhead rejects a call, either because
+// its queue is full or because the call's context was done while it was
+// queued. In the latter case Err is the context's error.
+type BulkheadError struct {
+	InFlight int
+	Queued   int
+	Err      error
+}
+
+func (e *BulkheadError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%v (%d in flight, %d queued): %v", ErrBulkheadFull, e.InFlight, e.Queued, e.Err)
+	}
+	return fmt.Sprintf("%v (%d in flight, %d queued)", ErrBulkheadFull, e.InFlight, e.Queued)
+}
+
+func (e *BulkheadError) Is(target error) bool {
+	return target == ErrBulkheadFull
+}
+
+func (e *BulkheadError) Unwrap() error {
+	return e.Err
+}
+
+// Bulkhead caps the number of concurrent calls to the effectors that share
+// it, so that a slow dependency can't tie up every goroutine in a service.
+// Calls beyond the cap wait in a bounded queue until a slot frees up or
+// their context is done. A Bulkhead is safe for concurrent use.
+type Bulkhead struct {
+	slots    chan struct{} // One element per call in flight
+	maxQueue int
+	queued   atomic.Int64
+}
+
+// NewBulkhead returns a Bulkhead that allows maxConcurrent calls in flight
+// (at least one) and up to maxQueue more to wait for a slot. If maxQueue
+// is zero, calls are rejected as soon as every slot is taken.
+func NewBulkhead(maxConcurrent, maxQueue int) *Bulkhead {
+	return &Bulkhead{
+		slots:    make(chan struct{}, max(maxConcurrent, 1)),
+		maxQueue: maxQueue,
+	}
+}
+
+// InFlight returns the number of calls currently in flight.
+func (b *Bulkhead) InFlight() int {
+	return len(b.slots)
+}
+
+// Queued returns the number of calls currently waiting for a slot.
+func (b *Bulkhead) Queued() int {
+	return int(b.queued.Load())
+}
+
+// Acquire takes a slot, waiting in the queue if there's room. On success
+// the caller must call release when its call is done. Calling release
+// more than once has no further effect.
+func (b *Bulkhead) Acquire(ctx context.Context) (release func(), err error) {
+	var once sync.Once
+	release = func() { once.Do(func() { <-b.slots }) }
+
+	select {
+	case b.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if b.queued.Add(1) > int64(b.maxQueue) {
+		b.queued.Add(-1)
+		return nil, &BulkheadError{InFlight: b.InFlight(), Queued: b.Queued()}
+	}
+	defer b.queued.Add(-1)
+
+	select {
+	case b.slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, &BulkheadError{InFlight: b.InFlight(), Queued: b.Queued() - 1, Err: ctx.Err()}
+	}
+}
+
+// BulkheadWith returns an Effector that calls e only once it has a slot
+// in b.
+func BulkheadWith(b *Bulkhead, e Effector) Effector {
+	return BulkheadWithOf(b, e)
+}
+
+// BulkheadWithOf is the generic form of BulkheadWith.
+func BulkheadWithOf[T any](b *Bulkhead, e EffectorOf[T]) EffectorOf[T] {
+	return func(ctx context.Context) (T, error) {
+		release, err := b.Acquire(ctx)
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+		defer release()
+
+		return e(ctx)
+	}
+}
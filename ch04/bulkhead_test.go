@@ -0,0 +1,165 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingEffector returns an Effector that blocks until release is
+// closed, signalling started each time it's called.
+func blockingEffector(started chan<- struct{}, release <-chan struct{}) Effector {
+	return func(ctx context.Context) (string, error) {
+		started <- struct{}{}
+		<-release
+		return "Success", nil
+	}
+}
+
+// TestBulkheadRejects tests that calls beyond the concurrency cap and the
+// queue are rejected with a BulkheadError.
+func TestBulkheadRejects(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+
+	b := NewBulkhead(2, 1)
+	e := BulkheadWith(b, blockingEffector(started, release))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := e(context.Background()); err != nil {
+				t.Error("unexpected error:", err)
+			}
+		}()
+	}
+
+	<-started
+	<-started
+	for b.Queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if b.InFlight() != 2 {
+		t.Error("expected 2 in flight; got", b.InFlight())
+	}
+
+	_, err := e(context.Background())
+
+	var be *BulkheadError
+	if !errors.Is(err, ErrBulkheadFull) || !errors.As(err, &be) {
+		t.Fatal("expected BulkheadError; got", err)
+	}
+
+	if be.InFlight != 2 || be.Queued != 1 || be.Err != nil {
+		t.Error("unexpected error details:", be)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if b.InFlight() != 0 || b.Queued() != 0 {
+		t.Errorf("expected empty bulkhead; got %d in flight, %d queued", b.InFlight(), b.Queued())
+	}
+}
+
+// TestBulkheadQueueTimeout tests that a queued call gives up when its
+// context is done.
+func TestBulkheadQueueTimeout(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+
+	b := NewBulkhead(1, 1)
+	e := BulkheadWith(b, blockingEffector(started, release))
+
+	go e(context.Background())
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := e(ctx)
+	if !errors.Is(err, ErrBulkheadFull) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected queue timeout; got", err)
+	}
+
+	if b.Queued() != 0 {
+		t.Error("expected empty queue; got", b.Queued())
+	}
+}
+
+// TestBulkheadNoQueue tests that a Bulkhead with no queue rejects calls
+// as soon as every slot is taken.
+func TestBulkheadNoQueue(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+
+	b := NewBulkhead(1, 0)
+	e := BulkheadWith(b, blockingEffector(started, release))
+
+	go e(context.Background())
+	<-started
+
+	if _, err := e(context.Background()); !errors.Is(err, ErrBulkheadFull) {
+		t.Error("expected ErrBulkheadFull; got", err)
+	}
+}
+
+// TestBulkheadReleaseTwice tests that releasing a slot twice doesn't free
+// a slot held by another call.
+func TestBulkheadReleaseTwice(t *testing.T) {
+	b := NewBulkhead(2, 0)
+
+	release, err := b.Acquire(context.Background())
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	other, err := b.Acquire(context.Background())
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer other()
+
+	release()
+	release()
+
+	if b.InFlight() != 1 {
+		t.Error("expected 1 in flight; got", b.InFlight())
+	}
+}
+
+// TestBulkheadZeroConcurrent tests that a Bulkhead created with no slots
+// still allows one call in flight.
+func TestBulkheadZeroConcurrent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	e := BulkheadWith(NewBulkhead(0, 1), countingEffector(new(int), nil))
+
+	if res, err := e(ctx); err != nil || res != "Success" {
+		t.Errorf("unexpected result: %q, %v", res, err)
+	}
+}
@@ -16,59 +16,187 @@
 
 package ch04
 
-import "sync"
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ChordPolicy determines when a chord emits.
+type ChordPolicy int
+
+const (
+	// ChordAll emits once every source has reported since the previous
+	// emission.
+	ChordAll ChordPolicy = iota
+
+	// ChordTimeout emits once every source has reported since the previous
+	// emission, or once ChordOptions.Timeout has passed since the first of
+	// them did, whichever is first.
+	ChordTimeout
+
+	// ChordAny emits whenever any source reports.
+	ChordAny
+)
+
+// ChordOptions configures ChordWith.
+type ChordOptions struct {
+	Policy ChordPolicy
+
+	// Timeout is how long a ChordTimeout chord waits for the remaining
+	// sources once the first has reported.
+	Timeout time.Duration
+}
 
-func Chord(sources ...<-chan int) <-chan []int {
-	type input struct { // Used to send inputs
-		idx, input int // between goroutines
-	}
+// ChordResult is emitted by ChordWith. Each slice has an element per
+// source, in the order they were passed.
+type ChordResult[T any] struct {
+	// Values holds the latest value from each source.
+	Values []T
+
+	// Known reports whether each source has ever reported. The value of a
+	// source that hasn't is the zero value.
+	Known []bool
 
-	dest := make(chan []int) // The output channel
+	// Updated reports whether each source has reported since the previous
+	// emission.
+	Updated []bool
+}
+
+// Chord returns a channel that emits the latest value from every source
+// once each of them has reported since the previous emission. It's closed
+// once every source is closed.
+func Chord(sources ...<-chan int) <-chan []int {
+	return ChordOf(sources...)
+}
 
-	inputs := make(chan input) // An intermediate channel
+// ChordOf is the generic form of Chord.
+func ChordOf[T any](sources ...<-chan T) <-chan []T {
+	return chord(context.Background(), ChordOptions{Policy: ChordAll}, sources,
+		func(r ChordResult[T]) []T { return r.Values })
+}
 
-	wg := sync.WaitGroup{} // Used to close channels when
-	wg.Add(len(sources))   // all sources are closed
+// ChordWith is like ChordOf, but emits according to opts.Policy, and stops
+// when ctx is done as well as when every source is closed. When a
+// ChordTimeout chord's sources are all closed, anything reported since the
+// previous emission is emitted before the channel closes.
+func ChordWith[T any](ctx context.Context, opts ChordOptions, sources ...<-chan T) <-chan ChordResult[T] {
+	return chord(ctx, opts, sources, func(r ChordResult[T]) ChordResult[T] { return r })
+}
 
-	for i, ch := range sources { // Start goroutine for each source
-		go func(i int, ch <-chan int) {
-			defer wg.Done() // Notify WaitGroup when ch closes
+// chordInput is a value from the source at index idx.
+type chordInput[T any] struct {
+	idx   int
+	value T
+}
 
-			for n := range ch {
-				inputs <- input{i, n} // Transfer input to next goroutine
+// chord implements the Chord functions. Each emission is passed to convert
+// before it's sent.
+func chord[T, R any](ctx context.Context, opts ChordOptions, sources []<-chan T, convert func(ChordResult[T]) R) <-chan R {
+	dest := make(chan R)
+	inputs := make(chan chordInput[T])
+
+	var wg sync.WaitGroup
+	wg.Add(len(sources))
+
+	for i, ch := range sources {
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case v, ok := <-ch:
+					if !ok {
+						return
+					}
+					select {
+					case inputs <- chordInput[T]{i, v}:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
 			}
-		}(i, ch)
+		}()
 	}
 
 	go func() {
-		wg.Wait()     // Wait for all sources to close
-		close(inputs) // then close inputs channel
+		wg.Wait()
+		close(inputs)
 	}()
 
 	go func() {
-		res := make([]int, len(sources))   // Slice for incoming inputs
-		sent := make([]bool, len(sources)) // Slice to track sent status
-		count := len(sources)              // Counter for channels
+		defer close(dest)
 
-		for r := range inputs {
-			res[r.idx] = r.input // Update incoming input
+		n := len(sources)
+		values := make([]T, n)
+		known := make([]bool, n)
+		updated := make([]bool, n)
+		count := 0 // The number of sources updated since the last emission
 
-			if !sent[r.idx] { // First input from channel?
-				sent[r.idx] = true
-				count--
-			}
+		var timer *time.Timer
+		var timeout <-chan time.Time
 
-			if count == 0 {
-				c := make([]int, len(res)) // Copy and send inputs slice
-				copy(c, res)
-				dest <- c
+		emit := func() bool {
+			r := ChordResult[T]{slices.Clone(values), slices.Clone(known), slices.Clone(updated)}
 
-				count = len(sources) // Reset counter
-				clear(sent)          // Clear status tracker
+			clear(updated)
+			count = 0
+			if timer != nil {
+				timer.Stop()
+				timeout = nil
+			}
+
+			select {
+			case dest <- convert(r):
+				return true
+			case <-ctx.Done():
+				return false
 			}
 		}
 
-		close(dest)
+		for {
+			select {
+			case in, ok := <-inputs:
+				if !ok {
+					if opts.Policy == ChordTimeout && count > 0 {
+						emit()
+					}
+					return
+				}
+
+				values[in.idx], known[in.idx] = in.value, true
+				if !updated[in.idx] {
+					updated[in.idx] = true
+					count++
+				}
+
+				switch {
+				case opts.Policy == ChordAny, count == n:
+					if !emit() {
+						return
+					}
+
+				case opts.Policy == ChordTimeout && count == 1:
+					if timer == nil {
+						timer = time.NewTimer(opts.Timeout)
+					} else {
+						timer.Reset(opts.Timeout)
+					}
+					timeout = timer.C
+				}
+
+			case <-timeout:
+				if !emit() {
+					return
+				}
+
+			case <-ctx.Done():
+				return
+			}
+		}
 	}()
 
 	return dest
@@ -17,7 +17,9 @@
 package ch04
 
 import (
+	"context"
 	"fmt"
+	"slices"
 	"testing"
 	"time"
 )
@@ -65,3 +67,108 @@ func TestChord(t *testing.T) {
 		idx++
 	}
 }
+
+// TestChordOf tests a chord of a non-int type.
+func TestChordOf(t *testing.T) {
+	ch1 := make(chan string)
+	ch2 := make(chan string)
+
+	go func() {
+		ch1 <- "a"
+		ch2 <- "b"
+		close(ch1)
+		close(ch2)
+	}()
+
+	var got [][]string
+	for ss := range ChordOf(ch1, ch2) {
+		got = append(got, ss)
+	}
+
+	if len(got) != 1 || !slices.Equal(got[0], []string{"a", "b"}) {
+		t.Error("expected [[a b]]; got", got)
+	}
+}
+
+// TestChordTimeout tests that a ChordTimeout chord emits the latest known
+// values when a source stalls.
+func TestChordTimeout(t *testing.T) {
+	fast := make(chan int)
+	stalled := make(chan int)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	res := ChordWith(ctx, ChordOptions{Policy: ChordTimeout, Timeout: 50 * time.Millisecond}, fast, stalled)
+
+	stalled <- 1
+	fast <- 2
+
+	r := <-res
+	if !slices.Equal(r.Values, []int{2, 1}) || !slices.Equal(r.Updated, []bool{true, true}) {
+		t.Errorf("expected [2 1] with both updated; got %+v", r)
+	}
+
+	start := time.Now()
+	fast <- 3
+
+	r = <-res
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Error("expected to wait for the timeout; took", elapsed)
+	}
+
+	if !slices.Equal(r.Values, []int{3, 1}) || !slices.Equal(r.Updated, []bool{true, false}) {
+		t.Errorf("expected [3 1] with only the first updated; got %+v", r)
+	}
+}
+
+// TestChordAny tests that a ChordAny chord emits on every update, and
+// reports which sources are known.
+func TestChordAny(t *testing.T) {
+	ch1 := make(chan int)
+	ch2 := make(chan int)
+
+	res := ChordWith(context.Background(), ChordOptions{Policy: ChordAny}, ch1, ch2)
+
+	ch1 <- 1
+	r := <-res
+
+	if !slices.Equal(r.Values, []int{1, 0}) || !slices.Equal(r.Known, []bool{true, false}) {
+		t.Errorf("expected [1 0] with only the first known; got %+v", r)
+	}
+
+	ch2 <- 2
+	<-res
+	ch1 <- 3
+	r = <-res
+
+	if !slices.Equal(r.Values, []int{3, 2}) || !slices.Equal(r.Updated, []bool{true, false}) {
+		t.Errorf("expected [3 2] with only the first updated; got %+v", r)
+	}
+
+	close(ch1)
+	close(ch2)
+
+	if _, ok := <-res; ok {
+		t.Error("expected chord to close")
+	}
+}
+
+// TestChordContext tests that a chord stops when its context is done, even
+// if its sources never report or close.
+func TestChordContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	res := ChordWith(ctx, ChordOptions{}, make(chan int), make(chan int))
+
+	cancel()
+
+	select {
+	case _, ok := <-res:
+		if ok {
+			t.Error("expected no emissions")
+		}
+	case <-time.After(time.Second):
+		t.Error("expected chord to close")
+	}
+}
@@ -19,18 +19,68 @@ package ch04
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 )
 
-type Circuit func(context.Context) (string, error)
+// CircuitOf is a function that interacts with a downstream service and
+// returns a result of type T. All of the stability patterns in this
+// package are parameterized by their result type.
+type CircuitOf[T any] func(context.Context) (T, error)
+
+// Circuit is a CircuitOf that returns a string.
+type Circuit = CircuitOf[string]
+
+var (
+	// ErrCircuitOpen is returned by a breaker that refuses to call its
+	// circuit. The error actually returned may wrap it with more detail,
+	// so test for it with errors.Is.
+	ErrCircuitOpen = errors.New("service unreachable")
+
+	// ErrTooManyProbes is returned by a half-open CircuitBreaker whose
+	// probe budget is exhausted. It wraps ErrCircuitOpen.
+	ErrTooManyProbes = fmt.Errorf("%w: too many probe requests", ErrCircuitOpen)
+)
+
+// OpenCircuitError is returned by a breaker that's open. It reports when
+// the breaker will next allow an attempt. It matches ErrCircuitOpen when
+// tested with errors.Is.
+type OpenCircuitError struct {
+	RetryAt time.Time
+}
+
+func (e *OpenCircuitError) Error() string {
+	return fmt.Sprintf("%v: circuit open until %s", ErrCircuitOpen, e.RetryAt.Format(time.RFC3339))
+}
+
+func (e *OpenCircuitError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// RetryAfter returns how long after now the breaker will allow another
+// attempt, rounded up to the next whole second to suit an HTTP
+// Retry-After header. It's never negative.
+func (e *OpenCircuitError) RetryAfter(now time.Time) time.Duration {
+	d := e.RetryAt.Sub(now)
+	if d <= 0 {
+		return 0
+	}
+
+	return (d + time.Second - 1).Truncate(time.Second)
+}
 
 func Breaker(circuit Circuit, threshold int) Circuit {
+	return BreakerOf(circuit, threshold)
+}
+
+// BreakerOf is the generic form of Breaker.
+func BreakerOf[T any](circuit CircuitOf[T], threshold int) CircuitOf[T] {
 	var failures int
 	var last = time.Now()
 	var m sync.RWMutex
 
-	return func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (T, error) {
 		m.RLock() // Establish a "read lock"
 
 		d := failures - threshold
@@ -39,7 +89,8 @@ func Breaker(circuit Circuit, threshold int) Circuit {
 			shouldRetryAt := last.Add((2 << d) * time.Second)
 			if !time.Now().After(shouldRetryAt) {
 				m.RUnlock()
-				return "", errors.New("service unreachable")
+				var zero T
+				return zero, &OpenCircuitError{RetryAt: shouldRetryAt}
 			}
 		}
 
@@ -62,3 +113,355 @@ func Breaker(circuit Circuit, threshold int) Circuit {
 		return response, nil
 	}
 }
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState int
+
+const (
+	// StateClosed lets all requests through, counting their outcomes.
+	StateClosed BreakerState = iota
+
+	// StateOpen rejects all requests until the open timeout elapses.
+	StateOpen
+
+	// StateHalfOpen lets a limited number of probe requests through. If
+	// they all succeed the breaker closes; if any fails it opens again.
+	StateHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("unknown state %d", int(s))
+	}
+}
+
+// BreakerCounts holds the request outcomes observed by a CircuitBreaker
+// since the last time its counts were reset. Counts are reset on every
+// state change, and periodically while closed if an Interval is set.
+type BreakerCounts struct {
+	Requests             uint32
+	Successes            uint32
+	Failures             uint32
+	ConsecutiveSuccesses uint32
+	ConsecutiveFailures  uint32
+}
+
+func (c *BreakerCounts) onRequest() {
+	c.Requests++
+}
+
+func (c *BreakerCounts) onSuccess() {
+	c.Successes++
+	c.ConsecutiveSuccesses++
+	c.ConsecutiveFailures = 0
+}
+
+func (c *BreakerCounts) onFailure() {
+	c.Failures++
+	c.ConsecutiveFailures++
+	c.ConsecutiveSuccesses = 0
+}
+
+// TripPolicy is called with the current counts after every failure in
+// the closed state. If it returns true, the breaker opens.
+type TripPolicy func(counts BreakerCounts) bool
+
+// ConsecutiveFailures returns a TripPolicy that opens the breaker after
+// n failures in a row.
+func ConsecutiveFailures(n uint32) TripPolicy {
+	return func(counts BreakerCounts) bool {
+		return counts.ConsecutiveFailures >= n
+	}
+}
+
+// FailureRatio returns a TripPolicy that opens the breaker once at least
+// minRequests requests have been made and the fraction of them that
+// failed is at least ratio.
+func FailureRatio(ratio float64, minRequests uint32) TripPolicy {
+	return func(counts BreakerCounts) bool {
+		if counts.Requests < minRequests || counts.Requests == 0 {
+			return false
+		}
+
+		return float64(counts.Failures)/float64(counts.Requests) >= ratio
+	}
+}
+
+// BreakerOptions configures a CircuitBreaker. The zero value is usable:
+// every field has a default.
+type BreakerOptions struct {
+	// ShouldTrip decides when a closed breaker opens. Defaults to
+	// ConsecutiveFailures(5).
+	ShouldTrip TripPolicy
+
+	// Interval is how often the counts are reset while the breaker is
+	// closed. If zero, counts are only reset when the state changes.
+	Interval time.Duration
+
+	// OpenTimeout is how long the breaker stays open before it moves to
+	// half-open. Defaults to 5 seconds.
+	OpenTimeout time.Duration
+
+	// HalfOpenRequests is the probe budget: the number of requests let
+	// through while half-open. That many consecutive successes close the
+	// breaker. Defaults to 1.
+	HalfOpenRequests uint32
+
+	// IsFailure classifies errors returned by the circuit. Errors for which
+	// it returns false are counted as successes. Defaults to err != nil.
+	IsFailure func(err error) bool
+
+	// Clock provides the current time. Defaults to the system clock.
+	Clock Clock
+
+	// OnStateChange, if set, is called whenever the breaker changes state.
+	// It's called while the breaker's lock is held, so it must not call
+	// back into the breaker.
+	OnStateChange func(from, to BreakerState)
+}
+
+// CircuitBreakerOf is a circuit breaker with explicit closed, open and
+// half-open states. Unlike Breaker, which uses a fixed backoff, its trip
+// policy, probe budget and error classification are configurable.
+type CircuitBreakerOf[T any] struct {
+	circuit CircuitOf[T]
+	opts    BreakerOptions
+
+	m          sync.Mutex
+	state      BreakerState
+	generation uint64
+	counts     BreakerCounts
+	expiry     time.Time
+}
+
+// CircuitBreaker is a CircuitBreakerOf that wraps a Circuit.
+type CircuitBreaker = CircuitBreakerOf[string]
+
+// NewCircuitBreaker returns a closed CircuitBreaker that wraps circuit.
+func NewCircuitBreaker(circuit Circuit, opts BreakerOptions) *CircuitBreaker {
+	return NewCircuitBreakerOf(circuit, opts)
+}
+
+// NewCircuitBreakerOf is the generic form of NewCircuitBreaker.
+func NewCircuitBreakerOf[T any](circuit CircuitOf[T], opts BreakerOptions) *CircuitBreakerOf[T] {
+	if opts.ShouldTrip == nil {
+		opts.ShouldTrip = ConsecutiveFailures(5)
+	}
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = 5 * time.Second
+	}
+	if opts.HalfOpenRequests == 0 {
+		opts.HalfOpenRequests = 1
+	}
+	if opts.IsFailure == nil {
+		opts.IsFailure = func(err error) bool { return err != nil }
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+
+	cb := &CircuitBreakerOf[T]{circuit: circuit, opts: opts}
+	cb.newGeneration(opts.Clock.Now())
+
+	return cb
+}
+
+// BreakerWithOptions is a convenience function that wraps circuit in a
+// CircuitBreaker and returns its Execute method as a Circuit.
+func BreakerWithOptions(circuit Circuit, opts BreakerOptions) Circuit {
+	return BreakerWithOptionsOf(circuit, opts)
+}
+
+// BreakerWithOptionsOf is the generic form of BreakerWithOptions.
+func BreakerWithOptionsOf[T any](circuit CircuitOf[T], opts BreakerOptions) CircuitOf[T] {
+	return NewCircuitBreakerOf(circuit, opts).Execute
+}
+
+// Execute calls the wrapped circuit if the breaker allows it, and records
+// the outcome. Its signature matches CircuitOf[T].
+func (cb *CircuitBreakerOf[T]) Execute(ctx context.Context) (T, error) {
+	return cb.call(ctx, cb.circuit)
+}
+
+// call calls circuit if the breaker allows it, and records the outcome.
+// It lets one breaker guard circuits other than the one it was created
+// with, which is how a Policy shares its breaker across call sites.
+func (cb *CircuitBreakerOf[T]) call(ctx context.Context, circuit CircuitOf[T]) (T, error) {
+	generation, err := cb.beforeRequest()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	// A panic counts as a failure, so that a half-open breaker isn't left
+	// waiting forever for the outcome of its probe. The panic carries on.
+	panicked := true
+	defer func() {
+		if panicked {
+			cb.afterRequest(generation, true)
+		}
+	}()
+
+	response, err := circuit(ctx) // Issue the request proper
+	panicked = false
+
+	cb.afterRequest(generation, cb.opts.IsFailure(err))
+
+	return response, err
+}
+
+// BreakerStatus is a read-only view of a circuit breaker, for inspecting
+// one that's shared, such as a Policy's.
+type BreakerStatus interface {
+	State() BreakerState
+	Counts() BreakerCounts
+	NextAttempt() time.Time
+}
+
+// State returns the breaker's current state.
+func (cb *CircuitBreakerOf[T]) State() BreakerState {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+
+	state, _ := cb.currentState(cb.opts.Clock.Now())
+	return state
+}
+
+// Counts returns the request outcomes counted in the current state.
+func (cb *CircuitBreakerOf[T]) Counts() BreakerCounts {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+
+	cb.currentState(cb.opts.Clock.Now())
+	return cb.counts
+}
+
+// NextAttempt returns the time at which an open breaker will allow its
+// next attempt. If the breaker isn't open, it returns the current time.
+func (cb *CircuitBreakerOf[T]) NextAttempt() time.Time {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+
+	now := cb.opts.Clock.Now()
+	if state, _ := cb.currentState(now); state == StateOpen {
+		return cb.expiry
+	}
+
+	return now
+}
+
+// beforeRequest decides whether a request may proceed. If it may, it
+// counts the request and returns the current generation.
+func (cb *CircuitBreakerOf[T]) beforeRequest() (uint64, error) {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+
+	now := cb.opts.Clock.Now()
+	state, generation := cb.currentState(now)
+
+	switch {
+	case state == StateOpen:
+		return generation, &OpenCircuitError{RetryAt: cb.expiry}
+	case state == StateHalfOpen && cb.counts.Requests >= cb.opts.HalfOpenRequests:
+		return generation, ErrTooManyProbes
+	}
+
+	cb.counts.onRequest()
+
+	return generation, nil
+}
+
+// afterRequest records whether a request failed. Outcomes of requests
+// that started in an earlier generation are discarded.
+func (cb *CircuitBreakerOf[T]) afterRequest(before uint64, failed bool) {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+
+	now := cb.opts.Clock.Now()
+	state, generation := cb.currentState(now)
+	if generation != before {
+		return
+	}
+
+	if !failed {
+		cb.counts.onSuccess()
+
+		if state == StateHalfOpen && cb.counts.ConsecutiveSuccesses >= cb.opts.HalfOpenRequests {
+			cb.setState(StateClosed, now)
+		}
+
+		return
+	}
+
+	cb.counts.onFailure()
+
+	switch state {
+	case StateClosed:
+		if cb.opts.ShouldTrip(cb.counts) {
+			cb.setState(StateOpen, now)
+		}
+	case StateHalfOpen:
+		cb.setState(StateOpen, now)
+	}
+}
+
+// currentState returns the state as of now, advancing from open to
+// half-open, or to a new closed interval, if the relevant expiry has
+// passed. Must be called with cb.m held.
+func (cb *CircuitBreakerOf[T]) currentState(now time.Time) (BreakerState, uint64) {
+	switch cb.state {
+	case StateClosed:
+		if !cb.expiry.IsZero() && !now.Before(cb.expiry) {
+			cb.newGeneration(now)
+		}
+	case StateOpen:
+		if !now.Before(cb.expiry) {
+			cb.setState(StateHalfOpen, now)
+		}
+	}
+
+	return cb.state, cb.generation
+}
+
+// setState moves the breaker to state and starts a new generation.
+// Must be called with cb.m held.
+func (cb *CircuitBreakerOf[T]) setState(state BreakerState, now time.Time) {
+	if cb.state == state {
+		return
+	}
+
+	prev := cb.state
+	cb.state = state
+	cb.newGeneration(now)
+
+	if cb.opts.OnStateChange != nil {
+		cb.opts.OnStateChange(prev, state)
+	}
+}
+
+// newGeneration resets the counts and computes the expiry of the current
+// state. Must be called with cb.m held.
+func (cb *CircuitBreakerOf[T]) newGeneration(now time.Time) {
+	cb.generation++
+	cb.counts = BreakerCounts{}
+
+	switch cb.state {
+	case StateClosed:
+		if cb.opts.Interval > 0 {
+			cb.expiry = now.Add(cb.opts.Interval)
+		} else {
+			cb.expiry = time.Time{}
+		}
+	case StateOpen:
+		cb.expiry = now.Add(cb.opts.OpenTimeout)
+	default:
+		cb.expiry = time.Time{}
+	}
+}
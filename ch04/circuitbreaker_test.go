@@ -169,3 +169,413 @@ func TestCircuitBreakerDataRace(t *testing.T) {
 
 	wg.Wait()
 }
+
+// fakeClock is a Clock whose time only moves when advance is called.
+type fakeClock struct {
+	m   sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// switchable returns a Circuit that fails while *fail is true.
+func switchable(fail *bool) Circuit {
+	return func(ctx context.Context) (string, error) {
+		if *fail {
+			return "", errors.New("INTENTIONAL FAIL!")
+		}
+		return "Success", nil
+	}
+}
+
+// TestCircuitBreakerStates tests that a CircuitBreaker moves from closed
+// to open to half-open and back to closed.
+func TestCircuitBreakerStates(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	fail := true
+
+	var transitions []string
+
+	cb := NewCircuitBreaker(switchable(&fail), BreakerOptions{
+		ShouldTrip:  ConsecutiveFailures(3),
+		OpenTimeout: 10 * time.Second,
+		Clock:       clock,
+		OnStateChange: func(from, to BreakerState) {
+			transitions = append(transitions, from.String()+"->"+to.String())
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := cb.Execute(ctx); err == nil {
+			t.Fatal("expected circuit error; got none")
+		}
+	}
+
+	// The breaker is open: the circuit should not be called.
+	fail = false
+	if _, err := cb.Execute(ctx); err == nil {
+		t.Fatal("expected open breaker to reject request")
+	}
+
+	clock.advance(10 * time.Second)
+
+	// Half-open: one probe is allowed, and its success closes the breaker.
+	if _, err := cb.Execute(ctx); err != nil {
+		t.Fatal("expected probe to succeed; got", err)
+	}
+	if _, err := cb.Execute(ctx); err != nil {
+		t.Fatal("expected closed breaker to allow request; got", err)
+	}
+
+	expected := []string{"closed->open", "open->half-open", "half-open->closed"}
+	if strings.Join(transitions, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected transitions %v; got %v", expected, transitions)
+	}
+}
+
+// TestCircuitBreakerHalfOpenFailure tests that a failed probe reopens the
+// breaker for another full timeout.
+func TestCircuitBreakerHalfOpenFailure(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	fail := true
+
+	cb := NewCircuitBreaker(switchable(&fail), BreakerOptions{
+		ShouldTrip:  ConsecutiveFailures(1),
+		OpenTimeout: time.Second,
+		Clock:       clock,
+	})
+
+	cb.Execute(ctx)
+	clock.advance(time.Second)
+
+	if _, err := cb.Execute(ctx); err == nil || err.Error() != "INTENTIONAL FAIL!" {
+		t.Fatal("expected probe to reach the circuit; got", err)
+	}
+
+	fail = false
+	clock.advance(999 * time.Millisecond)
+
+	if _, err := cb.Execute(ctx); err == nil {
+		t.Fatal("expected breaker to have reopened")
+	}
+}
+
+// TestCircuitBreakerProbePanics tests that a probe that panics counts as a
+// failure, rather than using up the probe budget for good.
+func TestCircuitBreakerProbePanics(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	fail := true
+
+	cb := NewCircuitBreaker(switchable(&fail), BreakerOptions{
+		ShouldTrip:  ConsecutiveFailures(1),
+		OpenTimeout: time.Second,
+		Clock:       clock,
+	})
+
+	cb.Execute(ctx)
+	clock.advance(time.Second)
+
+	// Swap in a panicking circuit for the probe, and recover as net/http
+	// would.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected the panic to propagate")
+			}
+		}()
+
+		cb.call(ctx, func(ctx context.Context) (string, error) { panic("boom") })
+	}()
+
+	if s := cb.State(); s != StateOpen {
+		t.Error("expected the panic to reopen the breaker; got", s)
+	}
+
+	fail = false
+	clock.advance(time.Second)
+
+	if _, err := cb.Execute(ctx); err != nil {
+		t.Error("expected the next probe to be let through; got", err)
+	}
+}
+
+// TestCircuitBreakerProbeBudget tests that no more than HalfOpenRequests
+// concurrent probes are let through while half-open.
+func TestCircuitBreakerProbeBudget(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+
+	var calls int
+	var m sync.Mutex
+	release := make(chan struct{})
+	fail := true
+
+	circuit := func(ctx context.Context) (string, error) {
+		m.Lock()
+		calls++
+		m.Unlock()
+
+		if fail {
+			return "", errors.New("INTENTIONAL FAIL!")
+		}
+
+		<-release
+		return "Success", nil
+	}
+
+	cb := NewCircuitBreaker(circuit, BreakerOptions{
+		ShouldTrip:       ConsecutiveFailures(1),
+		OpenTimeout:      time.Second,
+		HalfOpenRequests: 2,
+		Clock:            clock,
+	})
+
+	cb.Execute(ctx)
+	fail = false
+	calls = 0
+	clock.advance(time.Second)
+
+	var wg sync.WaitGroup
+	var rejected int
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cb.Execute(ctx); err != nil {
+				m.Lock()
+				rejected++
+				m.Unlock()
+			}
+		}()
+	}
+
+	// Wait until the probes have reached the circuit and the rest have
+	// been rejected before letting the probes finish.
+	for {
+		m.Lock()
+		n := calls + rejected
+		m.Unlock()
+		if n == 10 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if calls != 2 || rejected != 8 {
+		t.Errorf("expected 2 probes and 8 rejections; got %d and %d", calls, rejected)
+	}
+}
+
+// TestCircuitBreakerFailureRatio tests the FailureRatio trip policy.
+func TestCircuitBreakerFailureRatio(t *testing.T) {
+	ctx := context.Background()
+	fail := false
+
+	cb := NewCircuitBreaker(switchable(&fail), BreakerOptions{
+		ShouldTrip: FailureRatio(0.5, 4),
+		Clock:      newFakeClock(),
+	})
+
+	// S, F, S: fewer than 4 requests, so no trip.
+	cb.Execute(ctx)
+	fail = true
+	cb.Execute(ctx)
+	fail = false
+	cb.Execute(ctx)
+
+	// Fourth request fails: 2/4 failures trips the breaker.
+	fail = true
+	cb.Execute(ctx)
+
+	fail = false
+	if _, err := cb.Execute(ctx); err == nil {
+		t.Error("expected breaker to have tripped")
+	}
+}
+
+// TestCircuitBreakerIsFailure tests that errors not classified as
+// failures don't trip the breaker.
+func TestCircuitBreakerIsFailure(t *testing.T) {
+	ctx := context.Background()
+	notFound := errors.New("not found")
+
+	cb := NewCircuitBreaker(
+		func(ctx context.Context) (string, error) { return "", notFound },
+		BreakerOptions{
+			ShouldTrip: ConsecutiveFailures(1),
+			IsFailure:  func(err error) bool { return err != nil && !errors.Is(err, notFound) },
+			Clock:      newFakeClock(),
+		})
+
+	for i := 0; i < 5; i++ {
+		if _, err := cb.Execute(ctx); !errors.Is(err, notFound) {
+			t.Fatal("expected circuit error; got", err)
+		}
+	}
+}
+
+// TestCircuitBreakerInterval tests that counts are reset each interval
+// while the breaker is closed.
+func TestCircuitBreakerInterval(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	fail := true
+
+	cb := NewCircuitBreaker(switchable(&fail), BreakerOptions{
+		ShouldTrip: ConsecutiveFailures(2),
+		Interval:   time.Minute,
+		Clock:      clock,
+	})
+
+	cb.Execute(ctx)
+	clock.advance(time.Minute)
+	cb.Execute(ctx)
+
+	fail = false
+	if _, err := cb.Execute(ctx); err != nil {
+		t.Error("expected breaker to still be closed; got", err)
+	}
+}
+
+// TestCircuitBreakerErrors tests that rejections can be told apart from
+// circuit errors, and that they report when to retry.
+func TestCircuitBreakerErrors(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	fail := true
+
+	cb := NewCircuitBreaker(switchable(&fail), BreakerOptions{
+		ShouldTrip:  ConsecutiveFailures(1),
+		OpenTimeout: 1500 * time.Millisecond,
+		Clock:       clock,
+	})
+
+	if _, err := cb.Execute(ctx); errors.Is(err, ErrCircuitOpen) {
+		t.Fatal("circuit error mistaken for rejection:", err)
+	}
+
+	_, err := cb.Execute(ctx)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatal("expected ErrCircuitOpen; got", err)
+	}
+
+	var oce *OpenCircuitError
+	if !errors.As(err, &oce) {
+		t.Fatal("expected *OpenCircuitError; got", err)
+	}
+
+	if d := oce.RetryAfter(clock.Now()); d != 2*time.Second {
+		t.Error("expected retry after 2s; got", d)
+	}
+
+	if !oce.RetryAt.Equal(cb.NextAttempt()) {
+		t.Errorf("RetryAt %v doesn't match NextAttempt %v", oce.RetryAt, cb.NextAttempt())
+	}
+
+	if !errors.Is(ErrTooManyProbes, ErrCircuitOpen) {
+		t.Error("expected ErrTooManyProbes to wrap ErrCircuitOpen")
+	}
+}
+
+// TestCircuitBreakerIntrospection tests State, Counts and NextAttempt.
+func TestCircuitBreakerIntrospection(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	fail := true
+
+	cb := NewCircuitBreaker(switchable(&fail), BreakerOptions{
+		ShouldTrip:  ConsecutiveFailures(2),
+		OpenTimeout: time.Second,
+		Clock:       clock,
+	})
+
+	cb.Execute(ctx)
+
+	if s := cb.State(); s != StateClosed {
+		t.Error("expected closed; got", s)
+	}
+	if c := cb.Counts(); c.Failures != 1 || c.ConsecutiveFailures != 1 {
+		t.Error("unexpected counts:", c)
+	}
+	if !cb.NextAttempt().Equal(clock.Now()) {
+		t.Error("expected closed breaker to allow an attempt now")
+	}
+
+	cb.Execute(ctx)
+
+	if s := cb.State(); s != StateOpen {
+		t.Error("expected open; got", s)
+	}
+	if next := cb.NextAttempt(); !next.Equal(clock.Now().Add(time.Second)) {
+		t.Error("unexpected next attempt:", next)
+	}
+
+	clock.advance(time.Second)
+
+	if s := cb.State(); s != StateHalfOpen {
+		t.Error("expected half-open; got", s)
+	}
+}
+
+// TestBreakerErrors tests that Breaker's rejections match ErrCircuitOpen.
+func TestBreakerErrors(t *testing.T) {
+	ctx := context.Background()
+	breaker := Breaker(failAfter(0), 1)
+
+	breaker(ctx)
+
+	_, err := breaker(ctx)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatal("expected ErrCircuitOpen; got", err)
+	}
+
+	var oce *OpenCircuitError
+	if !errors.As(err, &oce) || oce.RetryAt.Before(time.Now()) {
+		t.Error("expected a future retry time; got", err)
+	}
+}
+
+// TestBreakerOfStruct tests that a breaker can wrap a circuit that returns
+// a struct.
+func TestBreakerOfStruct(t *testing.T) {
+	type response struct {
+		Code int
+		Body []byte
+	}
+
+	ctx := context.Background()
+	breaker := BreakerOf(func(ctx context.Context) (response, error) {
+		return response{}, errors.New("INTENTIONAL FAIL!")
+	}, 1)
+
+	breaker(ctx)
+
+	res, err := breaker(ctx)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Error("expected ErrCircuitOpen; got", err)
+	}
+	if res.Code != 0 || res.Body != nil {
+		t.Error("expected zero response; got", res)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// CoalesceOptions configures Coalesce.
+type CoalesceOptions struct {
+	// CacheTTL, if positive, is how long a key's successful result is
+	// kept and returned to later callers without calling the function.
+	// Expired results are dropped when they're next looked up, or swept
+	// whenever the cache has doubled in size since the last sweep.
+	CacheTTL time.Duration
+
+	// Clock provides the current time. Defaults to the system clock.
+	Clock Clock
+}
+
+// Coalesce returns a function that coalesces concurrent calls for the same
+// key: the first caller for a key calls f, and callers that arrive while
+// that call is in flight wait for and share its result. Unlike
+// DebounceFirst, callers with different keys don't affect each other, and
+// no lock is held while f runs.
+//
+// Each caller can stop waiting when its own context is done. The shared
+// call is passed a context that isn't canceled by any one caller, but is
+// canceled once every caller waiting for it has given up.
+func Coalesce(f WithContext, opts CoalesceOptions) WithContext {
+	return CoalesceOf(f, opts)
+}
+
+// CoalesceOf is the generic form of Coalesce.
+func CoalesceOf[K comparable, T any](f WithContextOf[K, T], opts CoalesceOptions) WithContextOf[K, T] {
+	return newCoalescer(f, opts).do
+}
+
+func newCoalescer[K comparable, T any](f WithContextOf[K, T], opts CoalesceOptions) *coalescer[K, T] {
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+
+	return &coalescer[K, T]{
+		f:       f,
+		opts:    opts,
+		calls:   make(map[K]*coalescedCall[T]),
+		cache:   make(map[K]cachedResult[T]),
+		sweepAt: minSweep,
+	}
+}
+
+// minSweep is the smallest cache size at which expired results are swept.
+const minSweep = 64
+
+// coalescedCall is a call in flight, shared by its waiters.
+type coalescedCall[T any] struct {
+	done    chan struct{} // Closed when res and err are set
+	res     T
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// cachedResult is a result kept for CacheTTL.
+type cachedResult[T any] struct {
+	res     T
+	expires time.Time
+}
+
+type coalescer[K comparable, T any] struct {
+	f    WithContextOf[K, T]
+	opts CoalesceOptions
+
+	m       sync.Mutex
+	calls   map[K]*coalescedCall[T]
+	cache   map[K]cachedResult[T]
+	sweepAt int // The cache size at which to next sweep it
+}
+
+func (g *coalescer[K, T]) do(ctx context.Context, key K) (T, error) {
+	var zero T
+
+	if ctx.Err() != nil {
+		return zero, ctx.Err()
+	}
+
+	g.m.Lock()
+
+	if c, ok := g.cache[key]; ok {
+		if g.opts.Clock.Now().Before(c.expires) {
+			g.m.Unlock()
+			return c.res, nil
+		}
+		delete(g.cache, key)
+	}
+
+	c, ok := g.calls[key]
+	if !ok {
+		c = g.start(ctx, key)
+	}
+	c.waiters++
+
+	g.m.Unlock()
+
+	select {
+	case <-c.done:
+		return c.res, c.err
+
+	case <-ctx.Done():
+		g.m.Lock()
+		c.waiters--
+		if c.waiters == 0 && g.calls[key] == c {
+			delete(g.calls, key) // Let the next caller start afresh
+			c.cancel()
+		}
+		g.m.Unlock()
+
+		return zero, ctx.Err()
+	}
+}
+
+// start starts a shared call for key. Must be called with g.m held.
+func (g *coalescer[K, T]) start(ctx context.Context, key K) *coalescedCall[T] {
+	cctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	c := &coalescedCall[T]{done: make(chan struct{}), cancel: cancel}
+	g.calls[key] = c
+
+	go func() {
+		defer cancel()
+
+		c.res, c.err = g.f(cctx, key)
+
+		g.m.Lock()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		if c.err == nil && g.opts.CacheTTL > 0 {
+			g.store(key, c.res)
+		}
+		g.m.Unlock()
+
+		close(c.done)
+	}()
+
+	return c
+}
+
+// store caches res for key. Expired results are swept each time the cache
+// doubles in size, so that it stays in proportion to the live results at
+// an amortized constant cost per call. Must be called with g.m held.
+func (g *coalescer[K, T]) store(key K, res T) {
+	now := g.opts.Clock.Now()
+	g.cache[key] = cachedResult[T]{res, now.Add(g.opts.CacheTTL)}
+
+	if len(g.cache) < g.sweepAt {
+		return
+	}
+
+	for k, c := range g.cache {
+		if !now.Before(c.expires) {
+			delete(g.cache, k)
+		}
+	}
+
+	g.sweepAt = max(2*len(g.cache), minSweep)
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCoalesceSharesCall tests that concurrent callers for the same key
+// share one call, and that callers for other keys don't.
+func TestCoalesceSharesCall(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	coalesced := Coalesce(func(ctx context.Context, key string) (string, error) {
+		calls.Add(1)
+		<-release
+		return "value of " + key, nil
+	}, CoalesceOptions{})
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		for _, key := range []string{"hot", "cold"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := coalesced(context.Background(), key)
+				if err != nil || res != "value of "+key {
+					t.Errorf("unexpected result for %s: %q, %v", key, res, err)
+				}
+			}()
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond) // Let every caller arrive
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 2 {
+		t.Error("expected 2 calls; got", n)
+	}
+
+	// Once the shared call has returned, the next caller starts another.
+	coalesced(context.Background(), "hot")
+
+	if n := calls.Load(); n != 3 {
+		t.Error("expected 3 calls; got", n)
+	}
+}
+
+// TestCoalesceCallerCancel tests that one caller giving up doesn't cancel
+// the shared call for the others.
+func TestCoalesceCallerCancel(t *testing.T) {
+	release := make(chan struct{})
+
+	coalesced := Coalesce(func(ctx context.Context, key string) (string, error) {
+		select {
+		case <-release:
+			return "Success", nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}, CoalesceOptions{})
+
+	result := make(chan error)
+	go func() {
+		_, err := coalesced(context.Background(), "key")
+		result <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := coalesced(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected deadline exceeded; got", err)
+	}
+
+	close(release)
+
+	if err := <-result; err != nil {
+		t.Error("expected remaining caller to get result; got", err)
+	}
+}
+
+// TestCoalesceAllCallersCancel tests that the shared call is canceled when
+// every caller has given up.
+func TestCoalesceAllCallersCancel(t *testing.T) {
+	canceled := make(chan struct{})
+
+	coalesced := Coalesce(func(ctx context.Context, key string) (string, error) {
+		<-ctx.Done()
+		close(canceled)
+		return "", ctx.Err()
+	}, CoalesceOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	coalesced(ctx, "key")
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("shared call was never canceled")
+	}
+}
+
+// TestCoalesceCache tests that successful results are cached per key for
+// CacheTTL, and that errors aren't.
+func TestCoalesceCache(t *testing.T) {
+	clock := newFakeClock()
+	calls := map[string]int{}
+	var m sync.Mutex
+
+	coalesced := Coalesce(func(ctx context.Context, key string) (string, error) {
+		m.Lock()
+		defer m.Unlock()
+		calls[key]++
+		if key == "bad" {
+			return "", errors.New("INTENTIONAL FAIL!")
+		}
+		return key, nil
+	}, CoalesceOptions{CacheTTL: time.Second, Clock: clock})
+
+	for i := 0; i < 3; i++ {
+		coalesced(context.Background(), "good")
+		coalesced(context.Background(), "bad")
+	}
+
+	if calls["good"] != 1 || calls["bad"] != 3 {
+		t.Errorf("expected 1 and 3 calls; got %d and %d", calls["good"], calls["bad"])
+	}
+
+	clock.advance(time.Second)
+	coalesced(context.Background(), "good")
+
+	if calls["good"] != 2 {
+		t.Error("expected cached result to expire; got", calls["good"], "calls")
+	}
+}
+
+// TestCoalesceCacheSweep tests that expired results for keys that aren't
+// looked up again don't accumulate.
+func TestCoalesceCacheSweep(t *testing.T) {
+	clock := newFakeClock()
+
+	g := newCoalescer(func(ctx context.Context, key int) (int, error) {
+		return key, nil
+	}, CoalesceOptions{CacheTTL: time.Second, Clock: clock})
+
+	for i := 0; i < 1000; i++ {
+		g.do(context.Background(), i)
+		clock.advance(10 * time.Millisecond)
+	}
+
+	// At most about 100 results are live at once.
+	g.m.Lock()
+	n := len(g.cache)
+	g.m.Unlock()
+
+	if n > 2*100+1 {
+		t.Error("expected expired results to be swept; got", n, "cached")
+	}
+}
@@ -0,0 +1,273 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DebounceMode selects which calls in a burst invoke the circuit.
+type DebounceMode int
+
+const (
+	// DebounceLeading invokes the circuit for the first call in a burst.
+	// Later calls in the burst share its result.
+	DebounceLeading DebounceMode = 1 << iota
+
+	// DebounceTrailing invokes the circuit once a burst has ended. Every
+	// call in the burst waits for and shares its result.
+	DebounceTrailing
+
+	// DebounceLeadingTrailing invokes the circuit for the first call in a
+	// burst, and again once the burst has ended if there were any more
+	// calls. The first call gets the leading result; the rest share the
+	// trailing one.
+	DebounceLeadingTrailing = DebounceLeading | DebounceTrailing
+)
+
+func (m DebounceMode) String() string {
+	switch m {
+	case DebounceLeading:
+		return "leading"
+	case DebounceTrailing:
+		return "trailing"
+	case DebounceLeadingTrailing:
+		return "leading+trailing"
+	default:
+		return "unknown"
+	}
+}
+
+// DebounceOptions configures Debounce.
+type DebounceOptions struct {
+	// Mode selects which calls invoke the circuit. Defaults to
+	// DebounceTrailing.
+	Mode DebounceMode
+
+	// Wait is how long the circuit must go uncalled for a burst to end.
+	// Each call extends the burst.
+	Wait time.Duration
+
+	// MaxWait, if positive, bounds how long a burst can be extended by a
+	// steady stream of calls, measured from when its leading call returns
+	// if it has one, or else from its first call. A burst never ends while
+	// its leading call is still running, so the leading result is always
+	// shared for up to MaxWait after it's known.
+	MaxWait time.Duration
+}
+
+// Debounce returns a Circuit that groups calls into bursts: calls no more
+// than opts.Wait apart belong to the same burst. Depending on opts.Mode,
+// the circuit is invoked at the start of a burst, at its end, or both, and
+// every caller gets the result of one of those invocations. No caller ever
+// gets an error just because a later call superseded it.
+//
+// No lock is held while circuit runs. Each caller can stop waiting when its
+// own context is done; a shared invocation is passed a context that isn't
+// canceled by any one caller, but is canceled once every caller waiting for
+// it has given up.
+func Debounce(circuit Circuit, opts DebounceOptions) Circuit {
+	return DebounceOf(circuit, opts)
+}
+
+// DebounceOf is the generic form of Debounce.
+func DebounceOf[T any](circuit CircuitOf[T], opts DebounceOptions) CircuitOf[T] {
+	if opts.Mode&DebounceLeadingTrailing == 0 {
+		opts.Mode = DebounceTrailing
+	}
+
+	d := &debouncer[T]{circuit: circuit, opts: opts}
+
+	return d.do
+}
+
+// debounceCall is an invocation of the circuit, shared by its waiters.
+// Until started, ctx is the context of its most recent waiter.
+type debounceCall[T any] struct {
+	done    chan struct{} // Closed when res and err are set
+	settled bool          // Whether res and err are set; guarded by d.m
+	res     T
+	err     error
+	waiters int
+	ctx     context.Context
+	cancel  context.CancelFunc // Set when started
+}
+
+type debouncer[T any] struct {
+	circuit CircuitOf[T]
+	opts    DebounceOptions
+
+	m       sync.Mutex
+	active  bool // Whether a burst is in progress
+	first   time.Time
+	last    time.Time
+	timer   *time.Timer
+	leading *debounceCall[T] // This burst's leading call, if any
+	pending *debounceCall[T] // The trailing call, if any callers await one
+}
+
+func (d *debouncer[T]) do(ctx context.Context) (T, error) {
+	if ctx.Err() != nil {
+		var zero T
+		return zero, ctx.Err()
+	}
+
+	d.m.Lock()
+
+	now := time.Now()
+	var c *debounceCall[T]
+
+	switch {
+	case !d.active:
+		d.active, d.first, d.last = true, now, now
+		d.timer = time.AfterFunc(d.opts.Wait, d.fire)
+
+		if d.opts.Mode&DebounceLeading != 0 {
+			d.leading = d.start(&debounceCall[T]{ctx: ctx})
+			c = d.leading
+		} else {
+			c = d.join(ctx)
+		}
+
+	case d.opts.Mode&DebounceTrailing != 0:
+		d.last = now
+		c = d.join(ctx)
+
+	default:
+		d.last = now
+		if d.leading == nil {
+			d.leading = d.start(&debounceCall[T]{ctx: ctx})
+		}
+		c = d.leading
+	}
+
+	c.waiters++
+
+	d.m.Unlock()
+
+	return d.wait(ctx, c)
+}
+
+// join returns the pending trailing call, creating it if necessary. Must
+// be called with d.m held.
+func (d *debouncer[T]) join(ctx context.Context) *debounceCall[T] {
+	if d.pending == nil {
+		d.pending = &debounceCall[T]{done: make(chan struct{})}
+	}
+	d.pending.ctx = ctx
+
+	return d.pending
+}
+
+// start invokes the circuit for c in a new goroutine. Must be called with
+// d.m held.
+func (d *debouncer[T]) start(c *debounceCall[T]) *debounceCall[T] {
+	if c.done == nil {
+		c.done = make(chan struct{})
+	}
+
+	cctx, cancel := context.WithCancel(context.WithoutCancel(c.ctx))
+	c.ctx, c.cancel = nil, cancel
+
+	go func() {
+		defer cancel()
+
+		c.res, c.err = d.circuit(cctx)
+
+		d.m.Lock()
+		c.settled = true
+		if d.leading == c {
+			// Later callers share the result for Wait, and for no more than
+			// MaxWait, from now.
+			d.first = time.Now()
+			d.last = d.first
+			d.settle()
+		}
+		d.m.Unlock()
+
+		close(c.done)
+	}()
+
+	return c
+}
+
+// wait waits for c to finish or for ctx to be done, whichever is first.
+func (d *debouncer[T]) wait(ctx context.Context, c *debounceCall[T]) (T, error) {
+	select {
+	case <-c.done:
+		return c.res, c.err
+
+	case <-ctx.Done():
+		d.m.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			if c.cancel != nil {
+				c.cancel()
+			}
+			if d.leading == c {
+				d.leading = nil
+				d.settle()
+			}
+			if d.pending == c {
+				d.pending = nil
+			}
+		}
+		d.m.Unlock()
+
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// fire is called by the timer.
+func (d *debouncer[T]) fire() {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.settle()
+}
+
+// settle ends the burst if it's due to end, or rearms the timer for when
+// it will be. A burst can't end while its leading call is running, so the
+// timer is left idle until the leading call settles the burst itself.
+// Must be called with d.m held.
+func (d *debouncer[T]) settle() {
+	if !d.active || d.leading != nil && !d.leading.settled {
+		return
+	}
+
+	end := d.last.Add(d.opts.Wait)
+	if d.opts.MaxWait > 0 {
+		if limit := d.first.Add(d.opts.MaxWait); limit.Before(end) {
+			end = limit
+		}
+	}
+
+	if wait := time.Until(end); wait > 0 {
+		d.timer.Reset(wait)
+		return
+	}
+
+	if d.pending != nil {
+		d.start(d.pending)
+		d.pending = nil
+	}
+
+	d.active, d.leading, d.timer = false, nil, nil
+}
@@ -17,28 +17,18 @@
 package ch04
 
 import (
-	"context"
-	"sync"
 	"time"
 )
 
+// DebounceFirst returns a Circuit that invokes circuit for the first call,
+// and gives every call in the d that follows the same result. Calls that
+// arrive while the first is still running wait for its result rather than
+// invoking circuit again.
 func DebounceFirst(circuit Circuit, d time.Duration) Circuit {
-	var threshold time.Time
-	var result string
-	var err error
-	var m sync.Mutex
-
-	return func(ctx context.Context) (string, error) {
-		m.Lock()
-		defer m.Unlock()
-
-		if time.Now().Before(threshold) {
-			return result, err
-		}
-
-		result, err = circuit(ctx)
-		threshold = time.Now().Add(d)
+	return DebounceFirstOf(circuit, d)
+}
 
-		return result, err
-	}
+// DebounceFirstOf is the generic form of DebounceFirst.
+func DebounceFirstOf[T any](circuit CircuitOf[T], d time.Duration) CircuitOf[T] {
+	return DebounceOf(circuit, DebounceOptions{Mode: DebounceLeading, Wait: d, MaxWait: d})
 }
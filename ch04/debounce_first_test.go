@@ -19,10 +19,58 @@ package ch04
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// TestDebounceFirstCachesAfterResult tests that the result is shared for d
+// after the circuit returns, rather than for d after it was called.
+func TestDebounceFirstCachesAfterResult(t *testing.T) {
+	var calls atomic.Int32
+	debounce := DebounceFirst(countingCircuit(&calls, 80*time.Millisecond), 100*time.Millisecond)
+
+	if res, _ := debounce(context.Background()); res != "1" {
+		t.Error("expected result 1; got", res)
+	}
+
+	// 120ms after the first call, but only 40ms after its result.
+	time.Sleep(40 * time.Millisecond)
+
+	if res, _ := debounce(context.Background()); res != "1" {
+		t.Error("expected cached result 1; got", res)
+	}
+
+	if n := calls.Load(); n != 1 {
+		t.Error("expected 1 call; got", n)
+	}
+
+	// Calls within d don't extend it.
+	time.Sleep(80 * time.Millisecond)
+
+	if res, _ := debounce(context.Background()); res != "2" {
+		t.Error("expected a new result 2 once d has passed; got", res)
+	}
+}
+
+// TestDebounceFirstZero tests that with d of zero, callers share a result
+// only while the call is running, and that the burst ends as soon as it
+// returns.
+func TestDebounceFirstZero(t *testing.T) {
+	var calls atomic.Int32
+	debounce := DebounceFirst(countingCircuit(&calls, 50*time.Millisecond), 0)
+
+	for i, res := range debounceConcurrently(t, debounce, 5, 0) {
+		if res != "1" {
+			t.Errorf("call %d: expected result 1; got %s", i, res)
+		}
+	}
+
+	if res, _ := debounce(context.Background()); res != "2" {
+		t.Error("expected a new result 2; got", res)
+	}
+}
+
 // TestDebounceFirstDataRace tests for data races.
 func TestDebounceFirstDataRace(t *testing.T) {
 	ctx := context.Background()
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingCircuit returns a circuit that sleeps for delay and then returns
+// how many times it has been called.
+func countingCircuit(calls *atomic.Int32, delay time.Duration) Circuit {
+	return func(ctx context.Context) (string, error) {
+		n := calls.Add(1)
+		time.Sleep(delay)
+		return fmt.Sprint(n), nil
+	}
+}
+
+// debounceConcurrently calls debounce n times, interval apart, and returns
+// the results in call order.
+func debounceConcurrently(t *testing.T, debounce Circuit, n int, interval time.Duration) []string {
+	results := make([]string, n)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			res, err := debounce(context.Background())
+			if err != nil {
+				t.Errorf("call %d: unexpected error: %v", i, err)
+			}
+			results[i] = res
+		}(i)
+
+		time.Sleep(interval)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// TestDebounceLeadingDoesNotSerialize tests that callers that arrive during
+// a slow leading call share its result rather than queuing behind it.
+func TestDebounceLeadingDoesNotSerialize(t *testing.T) {
+	var calls atomic.Int32
+	debounce := Debounce(countingCircuit(&calls, 100*time.Millisecond),
+		DebounceOptions{Mode: DebounceLeading, Wait: time.Second})
+
+	start := time.Now()
+	results := debounceConcurrently(t, debounce, 10, 0)
+
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Error("callers serialized; took", elapsed)
+	}
+
+	for i, res := range results {
+		if res != "1" {
+			t.Errorf("call %d: expected result 1; got %s", i, res)
+		}
+	}
+
+	// Later calls in the burst get the stored result immediately.
+	start = time.Now()
+	if res, _ := debounce(context.Background()); res != "1" {
+		t.Error("expected stored result 1; got", res)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Error("expected stored result without waiting; took", elapsed)
+	}
+
+	if n := calls.Load(); n != 1 {
+		t.Error("expected 1 call; got", n)
+	}
+}
+
+// TestDebounceTrailing tests that every caller in a burst gets the result
+// of a single trailing call, rather than an error.
+func TestDebounceTrailing(t *testing.T) {
+	var calls atomic.Int32
+	debounce := Debounce(countingCircuit(&calls, 0), DebounceOptions{Wait: 50 * time.Millisecond})
+
+	results := debounceConcurrently(t, debounce, 5, 10*time.Millisecond)
+
+	for i, res := range results {
+		if res != "1" {
+			t.Errorf("call %d: expected result 1; got %s", i, res)
+		}
+	}
+
+	if n := calls.Load(); n != 1 {
+		t.Error("expected 1 call; got", n)
+	}
+}
+
+// TestDebounceLeadingTrailing tests that the first caller in a burst gets
+// the leading result and the rest get the trailing one, and that a burst of
+// one call doesn't trigger a trailing call.
+func TestDebounceLeadingTrailing(t *testing.T) {
+	var calls atomic.Int32
+	debounce := Debounce(countingCircuit(&calls, 0),
+		DebounceOptions{Mode: DebounceLeadingTrailing, Wait: 50 * time.Millisecond})
+
+	results := debounceConcurrently(t, debounce, 5, 10*time.Millisecond)
+
+	expected := []string{"1", "2", "2", "2", "2"}
+	for i := range results {
+		if results[i] != expected[i] {
+			t.Errorf("call %d: expected result %s; got %s", i, expected[i], results[i])
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond) // Let the burst end
+
+	if res, _ := debounce(context.Background()); res != "3" {
+		t.Error("expected leading result 3; got", res)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if n := calls.Load(); n != 3 {
+		t.Error("expected 3 calls; got", n)
+	}
+}
+
+// TestDebounceMaxWait tests that a steady stream of calls can't defer the
+// trailing call past MaxWait.
+func TestDebounceMaxWait(t *testing.T) {
+	var calls atomic.Int32
+	debounce := Debounce(countingCircuit(&calls, 0),
+		DebounceOptions{Wait: 50 * time.Millisecond, MaxWait: 100 * time.Millisecond})
+
+	var first time.Duration
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		start := time.Now()
+		debounce(context.Background())
+		first = time.Since(start)
+	}()
+
+	debounceConcurrently(t, debounce, 25, 10*time.Millisecond)
+	<-done
+
+	if first > 150*time.Millisecond {
+		t.Error("expected first call to return within MaxWait; took", first)
+	}
+
+	if n := calls.Load(); n < 2 {
+		t.Error("expected at least 2 calls; got", n)
+	}
+}
+
+// TestDebounceAllCallersCancel tests that a trailing call isn't made once
+// every caller waiting for it has given up.
+func TestDebounceAllCallersCancel(t *testing.T) {
+	var calls atomic.Int32
+	debounce := Debounce(countingCircuit(&calls, 0), DebounceOptions{Wait: 50 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := debounce(ctx); err != context.DeadlineExceeded {
+		t.Error("expected deadline exceeded; got", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if n := calls.Load(); n != 0 {
+		t.Error("expected no calls; got", n)
+	}
+}
@@ -0,0 +1,367 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// EvictionReason says why an ExpiringMap evicted an entry.
+type EvictionReason int
+
+const (
+	// EvictionExpired means the entry's TTL passed.
+	EvictionExpired EvictionReason = iota
+
+	// EvictionCapacity means the entry's shard was full, and it was the
+	// entry closest to expiring.
+	EvictionCapacity
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionExpired:
+		return "expired"
+	case EvictionCapacity:
+		return "capacity"
+	default:
+		return "unknown"
+	}
+}
+
+// ExpiringMapOptions configures an ExpiringMap.
+type ExpiringMapOptions[K comparable, V any] struct {
+	// Shards is the number of shards. Defaults to 1.
+	Shards int
+
+	// Hasher hashes keys. Defaults to DefaultHasher.
+	Hasher Hasher[K]
+
+	// TTL is how long entries added by Set live. If zero or less, they
+	// live until they're deleted or evicted to make room.
+	TTL time.Duration
+
+	// MaxEntriesPerShard, if positive, bounds the number of entries in each
+	// shard. Adding a key to a full shard evicts the entry closest to
+	// expiring, after any that already have.
+	MaxEntriesPerShard int
+
+	// SweepInterval, if positive, is how often each shard's background
+	// sweeper removes expired entries. Otherwise expired entries are only
+	// removed when they're read, or evicted to make room.
+	SweepInterval time.Duration
+
+	// OnEvict, if set, is called for each entry that's evicted, but not for
+	// those removed by Delete. It's called without any lock held, from
+	// whichever goroutine caused the eviction.
+	OnEvict func(key K, value V, reason EvictionReason)
+
+	// Clock provides the current time. Defaults to the system clock.
+	Clock Clock
+}
+
+// ExpiringMap is a sharded map whose entries each have a TTL, for use as
+// an in-process cache. Expired entries are never returned: they're removed
+// when they're read, and optionally by a sweeper per shard. Call Close to
+// stop the sweepers.
+type ExpiringMap[K comparable, V any] struct {
+	opts   ExpiringMapOptions[K, V]
+	shards []*expiringShard[K, V]
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// expiringEntry is an entry in an expiringShard. A zero expires means it
+// never expires.
+type expiringEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+	index   int // In the shard's heap
+}
+
+func (e *expiringEntry[K, V]) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// eviction is an entry to be passed to OnEvict.
+type eviction[K comparable, V any] struct {
+	key    K
+	value  V
+	reason EvictionReason
+}
+
+type expiringShard[K comparable, V any] struct {
+	sync.RWMutex
+	items    map[K]*expiringEntry[K, V]
+	expiries expiryHeap[K, V]
+}
+
+// NewExpiringMap creates and initializes a new ExpiringMap configured by
+// opts, and starts its sweepers if it has any.
+func NewExpiringMap[K comparable, V any](opts ExpiringMapOptions[K, V]) *ExpiringMap[K, V] {
+	if opts.Shards < 1 {
+		opts.Shards = 1
+	}
+	if opts.Hasher == nil {
+		opts.Hasher = DefaultHasher[K]()
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+
+	m := &ExpiringMap[K, V]{
+		opts:   opts,
+		shards: make([]*expiringShard[K, V], opts.Shards),
+		done:   make(chan struct{}),
+	}
+
+	for i := range m.shards {
+		m.shards[i] = &expiringShard[K, V]{items: make(map[K]*expiringEntry[K, V])}
+	}
+
+	if opts.SweepInterval > 0 {
+		m.wg.Add(len(m.shards))
+		for _, shard := range m.shards {
+			go m.sweep(shard)
+		}
+	}
+
+	return m
+}
+
+// sweep periodically removes expired entries from shard until the map is
+// closed.
+func (m *ExpiringMap[K, V]) sweep(shard *expiringShard[K, V]) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.opts.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			shard.Lock()
+			evicted := shard.removeExpired(m.opts.Clock.Now(), nil)
+			shard.Unlock()
+
+			m.notify(evicted)
+
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// Close stops the map's sweepers, and waits for them to finish. The map
+// can still be used afterwards, but expired entries are only removed when
+// they're read.
+func (m *ExpiringMap[K, V]) Close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+
+	m.wg.Wait()
+}
+
+func (m *ExpiringMap[K, V]) getShard(key K) *expiringShard[K, V] {
+	return m.shards[m.opts.Hasher(key)%uint64(len(m.shards))]
+}
+
+// notify passes each eviction to OnEvict.
+func (m *ExpiringMap[K, V]) notify(evicted []eviction[K, V]) {
+	if m.opts.OnEvict == nil {
+		return
+	}
+
+	for _, e := range evicted {
+		m.opts.OnEvict(e.key, e.value, e.reason)
+	}
+}
+
+// Load returns the value stored for key, and whether there was one that
+// hasn't expired.
+func (m *ExpiringMap[K, V]) Load(key K) (value V, ok bool) {
+	shard := m.getShard(key)
+	now := m.opts.Clock.Now()
+
+	shard.RLock()
+	e, ok := shard.items[key]
+	if ok && !e.expired(now) {
+		value = e.value
+		shard.RUnlock()
+		return value, true
+	}
+	shard.RUnlock()
+
+	if !ok {
+		return value, false
+	}
+
+	// The entry has expired. Remove it, unless it's been replaced since.
+	var evicted []eviction[K, V]
+
+	shard.Lock()
+	if e, ok := shard.items[key]; ok && e.expired(now) {
+		shard.remove(e)
+		evicted = append(evicted, eviction[K, V]{e.key, e.value, EvictionExpired})
+	}
+	shard.Unlock()
+
+	m.notify(evicted)
+
+	return value, false
+}
+
+// Get retrieves and returns a value from the map. If there's no value, or
+// it's expired, the zero value is returned; use Load to tell the
+// difference.
+func (m *ExpiringMap[K, V]) Get(key K) V {
+	v, _ := m.Load(key)
+	return v
+}
+
+// Set stores value for key with the map's TTL.
+func (m *ExpiringMap[K, V]) Set(key K, value V) {
+	m.SetWithTTL(key, value, m.opts.TTL)
+}
+
+// SetWithTTL stores value for key with its own TTL. If ttl is zero or
+// less, the entry doesn't expire.
+func (m *ExpiringMap[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	shard := m.getShard(key)
+	now := m.opts.Clock.Now()
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+
+	var evicted []eviction[K, V]
+
+	shard.Lock()
+
+	if e, ok := shard.items[key]; ok {
+		e.value, e.expires = value, expires
+		heap.Fix(&shard.expiries, e.index)
+	} else {
+		if limit := m.opts.MaxEntriesPerShard; limit > 0 && len(shard.items) >= limit {
+			evicted = shard.removeExpired(now, evicted)
+
+			for len(shard.items) >= limit {
+				e := shard.expiries[0]
+				shard.remove(e)
+				evicted = append(evicted, eviction[K, V]{e.key, e.value, EvictionCapacity})
+			}
+		}
+
+		e := &expiringEntry[K, V]{key: key, value: value, expires: expires}
+		shard.items[key] = e
+		heap.Push(&shard.expiries, e)
+	}
+
+	shard.Unlock()
+
+	m.notify(evicted)
+}
+
+// Delete removes a value from the map. If key doesn't exist in the map,
+// this method is a no-op.
+func (m *ExpiringMap[K, V]) Delete(key K) {
+	shard := m.getShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if e, ok := shard.items[key]; ok {
+		shard.remove(e)
+	}
+}
+
+// Len returns the number of entries in the map, including any that have
+// expired but haven't been removed yet.
+func (m *ExpiringMap[K, V]) Len() int {
+	n := 0
+
+	for _, shard := range m.shards {
+		shard.RLock()
+		n += len(shard.items)
+		shard.RUnlock()
+	}
+
+	return n
+}
+
+// remove removes e from the shard. Must be called with the shard locked.
+func (s *expiringShard[K, V]) remove(e *expiringEntry[K, V]) {
+	delete(s.items, e.key)
+	heap.Remove(&s.expiries, e.index)
+}
+
+// removeExpired removes every entry that has expired by now, appending
+// each to evicted. Must be called with the shard locked.
+func (s *expiringShard[K, V]) removeExpired(now time.Time, evicted []eviction[K, V]) []eviction[K, V] {
+	for len(s.expiries) > 0 && s.expiries[0].expired(now) {
+		e := s.expiries[0]
+		s.remove(e)
+		evicted = append(evicted, eviction[K, V]{e.key, e.value, EvictionExpired})
+	}
+
+	return evicted
+}
+
+// expiryHeap is a min-heap of entries ordered by expiry time, with entries
+// that never expire last. It implements heap.Interface.
+type expiryHeap[K comparable, V any] []*expiringEntry[K, V]
+
+func (h expiryHeap[K, V]) Len() int { return len(h) }
+
+func (h expiryHeap[K, V]) Less(i, j int) bool {
+	a, b := h[i].expires, h[j].expires
+
+	switch {
+	case a.IsZero():
+		return false
+	case b.IsZero():
+		return true
+	default:
+		return a.Before(b)
+	}
+}
+
+func (h expiryHeap[K, V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap[K, V]) Push(x any) {
+	e := x.(*expiringEntry[K, V])
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap[K, V]) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
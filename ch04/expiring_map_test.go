@@ -0,0 +1,184 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// evictionRecorder records the evictions passed to it by an ExpiringMap.
+type evictionRecorder struct {
+	sync.Mutex
+	evicted map[string]EvictionReason
+}
+
+func (r *evictionRecorder) onEvict(key string, value int, reason EvictionReason) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.evicted == nil {
+		r.evicted = map[string]EvictionReason{}
+	}
+	r.evicted[key] = reason
+}
+
+func (r *evictionRecorder) reason(key string) (EvictionReason, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	reason, ok := r.evicted[key]
+	return reason, ok
+}
+
+// TestExpiringMapLazyExpiry tests that expired entries aren't returned, and
+// are evicted when they're read.
+func TestExpiringMapLazyExpiry(t *testing.T) {
+	clock := newFakeClock()
+	rec := &evictionRecorder{}
+
+	m := NewExpiringMap(ExpiringMapOptions[string, int]{
+		Shards:  4,
+		TTL:     time.Minute,
+		OnEvict: rec.onEvict,
+		Clock:   clock,
+	})
+	defer m.Close()
+
+	m.Set("session", 1)
+	m.SetWithTTL("token", 2, time.Hour)
+	m.SetWithTTL("forever", 3, 0)
+
+	clock.advance(time.Minute)
+
+	if _, ok := m.Load("session"); ok {
+		t.Error("expected session to have expired")
+	}
+
+	if reason, ok := rec.reason("session"); !ok || reason != EvictionExpired {
+		t.Error("expected session to be evicted as expired; got", reason, ok)
+	}
+
+	if v, ok := m.Load("token"); !ok || v != 2 {
+		t.Errorf("expected 2, true; got %d, %v", v, ok)
+	}
+
+	clock.advance(24 * time.Hour)
+
+	if v, ok := m.Load("forever"); !ok || v != 3 {
+		t.Errorf("expected 3, true; got %d, %v", v, ok)
+	}
+
+	if n := m.Len(); n != 2 {
+		t.Error("expected 2 entries, including the unread expired one; got", n)
+	}
+}
+
+// TestExpiringMapSetRenews tests that setting a key again renews its TTL.
+func TestExpiringMapSetRenews(t *testing.T) {
+	clock := newFakeClock()
+	m := NewExpiringMap(ExpiringMapOptions[string, int]{TTL: time.Minute, Clock: clock})
+
+	m.Set("session", 1)
+	clock.advance(50 * time.Second)
+	m.Set("session", 2)
+	clock.advance(50 * time.Second)
+
+	if v, ok := m.Load("session"); !ok || v != 2 {
+		t.Errorf("expected 2, true; got %d, %v", v, ok)
+	}
+}
+
+// TestExpiringMapSweeper tests that the sweeper removes expired entries
+// without them being read, and stops when the map is closed.
+func TestExpiringMapSweeper(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	clock := newFakeClock()
+	rec := &evictionRecorder{}
+
+	m := NewExpiringMap(ExpiringMapOptions[string, int]{
+		Shards:        4,
+		TTL:           time.Minute,
+		SweepInterval: 5 * time.Millisecond,
+		OnEvict:       rec.onEvict,
+		Clock:         clock,
+	})
+
+	m.Set("alpha", 1)
+	m.Set("beta", 2)
+	clock.advance(time.Minute)
+
+	deadline := time.Now().Add(time.Second)
+	for m.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if n := m.Len(); n != 0 {
+		t.Error("expected sweeper to remove every entry;", n, "left")
+	}
+
+	if _, ok := rec.reason("beta"); !ok {
+		t.Error("expected beta to be evicted")
+	}
+
+	m.Close()
+	m.Close() // Closing twice is harmless
+}
+
+// TestExpiringMapCapacity tests that adding to a full shard evicts the
+// entry closest to expiring, reporting it as expired if it has.
+func TestExpiringMapCapacity(t *testing.T) {
+	clock := newFakeClock()
+	rec := &evictionRecorder{}
+
+	m := NewExpiringMap(ExpiringMapOptions[string, int]{
+		MaxEntriesPerShard: 2,
+		OnEvict:            rec.onEvict,
+		Clock:              clock,
+	})
+
+	m.SetWithTTL("short", 1, time.Second)
+	m.SetWithTTL("long", 2, time.Hour)
+	m.SetWithTTL("medium", 3, time.Minute)
+
+	if reason, ok := rec.reason("short"); !ok || reason != EvictionCapacity {
+		t.Error("expected short to be evicted for capacity; got", reason, ok)
+	}
+
+	m.SetWithTTL("expiring", 4, time.Second)
+
+	if reason, ok := rec.reason("medium"); !ok || reason != EvictionCapacity {
+		t.Error("expected medium to be evicted for capacity; got", reason, ok)
+	}
+
+	clock.advance(2 * time.Second)
+	m.SetWithTTL("another", 5, time.Hour)
+
+	if reason, ok := rec.reason("expiring"); !ok || reason != EvictionExpired {
+		t.Error("expected expiring to be evicted as expired; got", reason, ok)
+	}
+
+	if _, ok := m.Load("long"); !ok {
+		t.Error("expected long to remain")
+	}
+
+	if n := m.Len(); n != 2 {
+		t.Error("expected 2 entries; got", n)
+	}
+}
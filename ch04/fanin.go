@@ -0,0 +1,81 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"sync"
+)
+
+// FanIn returns a channel that receives every value sent on sources. It's
+// closed once every source is closed, or once ctx is done.
+func FanIn[T any](ctx context.Context, sources ...<-chan T) <-chan T {
+	dest := make(chan T)
+
+	var wg sync.WaitGroup
+	wg.Add(len(sources))
+
+	for _, ch := range sources {
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case v, ok := <-ch:
+					if !ok {
+						return
+					}
+					if !send(ctx, dest, v) {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(dest)
+	}()
+
+	return dest
+}
+
+// send sends v on ch, unless ctx is done first. It reports whether v was
+// sent.
+func send[T any](ctx context.Context, ch chan<- T, v T) bool {
+	select {
+	case ch <- v:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// receive receives a value from ch, unless ctx is done first. Like a
+// receive from a channel, ok is false if ch is closed; it's also false if
+// ctx is done.
+func receive[T any](ctx context.Context, ch <-chan T) (v T, ok bool) {
+	select {
+	case v, ok = <-ch:
+		return v, ok
+	case <-ctx.Done():
+		return v, false
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+)
+
+// checkGoroutines records the number of goroutines, and returns a function
+// that fails the test if there are more once they've had time to exit.
+// Use it as: defer checkGoroutines(t)()
+func checkGoroutines(t *testing.T) func() {
+	before := runtime.NumGoroutine()
+
+	return func() {
+		t.Helper()
+
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if runtime.NumGoroutine() <= before {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		t.Errorf("leaked %d goroutines", runtime.NumGoroutine()-before)
+	}
+}
+
+// generate returns a channel that's sent values and then closed.
+func generate[T any](values ...T) <-chan T {
+	ch := make(chan T)
+
+	go func() {
+		defer close(ch)
+		for _, v := range values {
+			ch <- v
+		}
+	}()
+
+	return ch
+}
+
+// TestFanIn tests that FanIn receives every value from every source.
+func TestFanIn(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	var got []int
+	for n := range FanIn(context.Background(), generate(1, 2, 3), generate(4, 5), generate[int]()) {
+		got = append(got, n)
+	}
+
+	slices.Sort(got)
+	if !slices.Equal(got, []int{1, 2, 3, 4, 5}) {
+		t.Error("expected [1 2 3 4 5]; got", got)
+	}
+}
+
+// TestFanInCancel tests that FanIn stops, without leaking goroutines, when
+// its context is done, even if its sources never close.
+func TestFanInCancel(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stalled := make(chan int)
+	buffered := make(chan int, 3)
+	buffered <- 1
+	buffered <- 2
+	buffered <- 3
+
+	dest := FanIn(ctx, stalled, buffered)
+	<-dest
+	cancel()
+
+	for range dest {
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"hash/maphash"
+)
+
+// FanOut returns n channels (at least one), and sends each value from
+// source to the next of them in turn. A slow destination holds up the
+// others. Every destination is closed once source is closed, or once ctx
+// is done.
+func FanOut[T any](ctx context.Context, source <-chan T, n int) []<-chan T {
+	n = max(n, 1)
+	next := 0
+
+	return fanOut(ctx, source, n, func(T) int {
+		i := next
+		next = (next + 1) % n
+		return i
+	})
+}
+
+// FanOutByKey is like FanOut, but every value with the same key is sent to
+// the same destination, so values for a key are received in order.
+func FanOutByKey[T any, K comparable](ctx context.Context, source <-chan T, n int, key func(T) K) []<-chan T {
+	n = max(n, 1)
+	seed := maphash.MakeSeed()
+
+	return fanOut(ctx, source, n, func(v T) int {
+		return int(maphash.Comparable(seed, key(v)) % uint64(n))
+	})
+}
+
+// fanOut implements the FanOut functions. pick returns the index of the
+// destination for a value; it's only ever called from one goroutine.
+func fanOut[T any](ctx context.Context, source <-chan T, n int, pick func(T) int) []<-chan T {
+	dests := make([]chan T, n)
+	result := make([]<-chan T, n)
+
+	for i := range dests {
+		dests[i] = make(chan T)
+		result[i] = dests[i]
+	}
+
+	go func() {
+		defer func() {
+			for _, ch := range dests {
+				close(ch)
+			}
+		}()
+
+		for {
+			v, ok := receive(ctx, source)
+			if !ok || !send(ctx, dests[pick(v)], v) {
+				return
+			}
+		}
+	}()
+
+	return result
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// collectAll reads every channel in chs concurrently until each is closed,
+// and returns what each received.
+func collectAll[T any](chs []<-chan T) [][]T {
+	results := make([][]T, len(chs))
+
+	var wg sync.WaitGroup
+	for i, ch := range chs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for v := range ch {
+				results[i] = append(results[i], v)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// TestFanOut tests that FanOut sends values to its destinations in turn.
+func TestFanOut(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	got := collectAll(FanOut(context.Background(), generate(1, 2, 3, 4, 5), 2))
+
+	if !slices.Equal(got[0], []int{1, 3, 5}) || !slices.Equal(got[1], []int{2, 4}) {
+		t.Error("expected [[1 3 5] [2 4]]; got", got)
+	}
+}
+
+// TestFanOutNoDestinations tests that FanOut and FanOutByKey use a single
+// destination if asked for fewer.
+func TestFanOutNoDestinations(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	got := collectAll(FanOut(context.Background(), generate(1, 2, 3), 0))
+	if len(got) != 1 || !slices.Equal(got[0], []int{1, 2, 3}) {
+		t.Error("expected [[1 2 3]]; got", got)
+	}
+
+	got = collectAll(FanOutByKey(context.Background(), generate(1, 2, 3), -1, func(v int) int { return v }))
+	if len(got) != 1 || !slices.Equal(got[0], []int{1, 2, 3}) {
+		t.Error("expected [[1 2 3]]; got", got)
+	}
+}
+
+// TestFanOutByKey tests that FanOutByKey sends every value with the same
+// key to the same destination, in order.
+func TestFanOutByKey(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	type reading struct {
+		sensor string
+		value  int
+	}
+
+	source := generate(
+		reading{"a", 1}, reading{"b", 1}, reading{"c", 1},
+		reading{"a", 2}, reading{"b", 2}, reading{"c", 2})
+
+	got := collectAll(FanOutByKey(context.Background(), source, 3,
+		func(r reading) string { return r.sensor }))
+
+	last := map[string]int{}
+	seen := map[string]int{}
+
+	for i, rs := range got {
+		for _, r := range rs {
+			if j, ok := seen[r.sensor]; ok && j != i {
+				t.Errorf("sensor %s sent to destinations %d and %d", r.sensor, j, i)
+			}
+			if r.value <= last[r.sensor] {
+				t.Errorf("sensor %s out of order: %v", r.sensor, rs)
+			}
+			seen[r.sensor], last[r.sensor] = i, r.value
+		}
+	}
+}
+
+// TestFanOutCancel tests that FanOut closes its destinations, without
+// leaking goroutines, when its context is done.
+func TestFanOutCancel(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dests := FanOut(ctx, make(chan int), 3)
+	cancel()
+
+	collectAll(dests)
+}
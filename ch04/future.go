@@ -22,21 +22,31 @@ import (
 	"time"
 )
 
-type Future interface {
-	Result() (string, error)
+// FutureOf is a placeholder for a result of type T that may not yet be
+// available.
+type FutureOf[T any] interface {
+	Result() (T, error)
 }
 
-type InnerFuture struct {
+// Future is a FutureOf a string.
+type Future = FutureOf[string]
+
+// InnerFutureOf implements FutureOf[T] by reading its result from a pair
+// of channels.
+type InnerFutureOf[T any] struct {
 	once sync.Once
 	wg   sync.WaitGroup
 
-	res   string
+	res   T
 	err   error
-	resCh <-chan string
+	resCh <-chan T
 	errCh <-chan error
 }
 
-func (f *InnerFuture) Result() (string, error) {
+// InnerFuture is an InnerFutureOf a string.
+type InnerFuture = InnerFutureOf[string]
+
+func (f *InnerFutureOf[T]) Result() (T, error) {
 	f.once.Do(func() {
 		f.wg.Add(1)
 		defer f.wg.Done()
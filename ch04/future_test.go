@@ -183,3 +183,21 @@ func elapsedCheck(t *testing.T, start time.Time, seconds int) {
 		t.Errorf("expected %d seconds; got %d\n", seconds, elapsed)
 	}
 }
+
+// TestFutureOfInt tests an InnerFutureOf a non-string type.
+func TestFutureOfInt(t *testing.T) {
+	resCh := make(chan int)
+	errCh := make(chan error)
+
+	go func() {
+		resCh <- 42
+		errCh <- nil
+	}()
+
+	var future FutureOf[int] = &InnerFutureOf[int]{resCh: resCh, errCh: errCh}
+
+	res, err := future.Result()
+	if err != nil || res != 42 {
+		t.Errorf("expected 42; got %d, %v", res, err)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"hash/fnv"
+	"hash/maphash"
+	"slices"
+)
+
+// Hasher hashes keys of type K. Equal keys must have equal hashes.
+type Hasher[K comparable] func(key K) uint64
+
+// DefaultHasher returns the Hasher that a ShardedMap uses unless it's
+// given another. Strings are hashed with StringHasher; keys of any other
+// type are hashed with ComparableHasher.
+func DefaultHasher[K comparable]() Hasher[K] {
+	var zero K
+
+	if _, ok := any(zero).(string); ok {
+		return func(key K) uint64 {
+			return fnv32a(any(key).(string))
+		}
+	}
+
+	return ComparableHasher[K]()
+}
+
+// StringHasher returns a Hasher that hashes keys with 32-bit FNV-1a. Its
+// hashes are stable across processes.
+func StringHasher[K ~string]() Hasher[K] {
+	return func(key K) uint64 {
+		return fnv32a(string(key))
+	}
+}
+
+// ComparableHasher returns a Hasher for keys of any comparable type,
+// based on hash/maphash. Its hashes are specific to the Hasher: two
+// Hashers, even in the same process, hash the same key differently.
+func ComparableHasher[K comparable]() Hasher[K] {
+	seed := maphash.MakeSeed()
+
+	return func(key K) uint64 {
+		return maphash.Comparable(seed, key)
+	}
+}
+
+func fnv32a(s string) uint64 {
+	hash := fnv.New32a()
+	hash.Write([]byte(s))
+	return uint64(hash.Sum32())
+}
+
+// ShardingStrategy determines how a ShardedMap maps hashes to shards.
+type ShardingStrategy int
+
+const (
+	// ModuloSharding takes a key's hash modulo the number of shards. It
+	// spreads keys evenly, but changing the number of shards moves almost
+	// every key.
+	ModuloSharding ShardingStrategy = iota
+
+	// JumpSharding uses jump consistent hashing. Changing the number of
+	// shards from n to m moves only the keys that must move, about
+	// |n-m|/max(n,m) of them.
+	JumpSharding
+
+	// RingSharding places a number of virtual nodes per shard on a
+	// consistent hash ring, and assigns each key to the next node around
+	// the ring from its hash. Like JumpSharding it moves few keys when the
+	// number of shards changes, at the cost of a less even spread and a
+	// binary search per lookup.
+	RingSharding
+)
+
+func (s ShardingStrategy) String() string {
+	switch s {
+	case ModuloSharding:
+		return "modulo"
+	case JumpSharding:
+		return "jump"
+	case RingSharding:
+		return "ring"
+	default:
+		return "unknown"
+	}
+}
+
+// mix64 scrambles h, so that hashes with few significant bits, such as
+// those from StringHasher, are spread across all 64.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// jumpHash returns the bucket in 0..n-1 for key, using the algorithm from
+// Lamping and Veach, "A Fast, Minimal Memory, Consistent Hash Algorithm".
+func jumpHash(key uint64, n int) int {
+	var b, j int64 = -1, 0
+
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
+
+// ringNode is a virtual node on a consistent hash ring.
+type ringNode struct {
+	hash  uint64
+	shard int
+}
+
+// hashRing is a consistent hash ring, sorted by hash.
+type hashRing []ringNode
+
+// newHashRing returns a ring with vnodes virtual nodes for each of n
+// shards. A shard's nodes are the same whatever n is, so adding a shard
+// only takes keys from the nodes just before its own.
+func newHashRing(n, vnodes int) hashRing {
+	ring := make(hashRing, 0, n*vnodes)
+
+	for shard := 0; shard < n; shard++ {
+		for v := 0; v < vnodes; v++ {
+			ring = append(ring, ringNode{mix64(uint64(shard)<<32 | uint64(v)), shard})
+		}
+	}
+
+	slices.SortFunc(ring, func(a, b ringNode) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		default:
+			return a.shard - b.shard
+		}
+	})
+
+	return ring
+}
+
+// shard returns the shard that owns h.
+func (r hashRing) shard(h uint64) int {
+	i, _ := slices.BinarySearchFunc(r, h, func(n ringNode, h uint64) int {
+		switch {
+		case n.hash < h:
+			return -1
+		case n.hash > h:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	if i == len(r) {
+		i = 0 // Wrap around
+	}
+
+	return r[i].shard
+}
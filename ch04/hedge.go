@@ -0,0 +1,182 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// HedgeOptions configures Hedge.
+type HedgeOptions struct {
+	// Delay is how long to wait for a call before issuing another,
+	// speculative, one.
+	Delay time.Duration
+
+	// Percentile, if positive, replaces Delay with the latency of recent
+	// successful calls at this percentile, for example 0.95. Delay is
+	// used until MinSamples calls have succeeded.
+	Percentile float64
+
+	// MinSamples is the number of successful calls to observe before
+	// using Percentile. Defaults to 20.
+	MinSamples int
+
+	// Samples is the number of recent successful calls whose latency is
+	// kept. Defaults to 100.
+	Samples int
+
+	// MaxAttempts is the maximum number of calls, including the first, to
+	// have in flight for each request. Defaults to 2.
+	MaxAttempts int
+}
+
+// Hedge returns an Effector that calls e and, if it hasn't returned
+// within the hedging delay, calls it again, up to MaxAttempts times. The
+// first call to succeed wins, and the others are canceled through their
+// contexts. A failed call makes way for the next one straightaway. If
+// every call fails, the last error is returned.
+//
+// Hedging trades extra load for lower tail latency, so e should be safe
+// to call more than once, and its backends should be replicated.
+func Hedge(e Effector, opts HedgeOptions) Effector {
+	return HedgeOf(e, opts)
+}
+
+// HedgeOf is the generic form of Hedge.
+func HedgeOf[T any](e EffectorOf[T], opts HedgeOptions) EffectorOf[T] {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 2
+	}
+	if opts.MinSamples <= 0 {
+		opts.MinSamples = 20
+	}
+	if opts.Samples <= 0 {
+		opts.Samples = 100
+	}
+
+	latencies := &latencyTracker{samples: make([]time.Duration, 0, opts.Samples)}
+
+	return func(ctx context.Context) (T, error) {
+		type result struct {
+			res T
+			err error
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel() // Cancel the losers
+
+		results := make(chan result, opts.MaxAttempts)
+		delay := opts.Delay
+		if opts.Percentile > 0 {
+			delay = latencies.percentile(opts.Percentile, opts.MinSamples, delay)
+		}
+
+		launch := func() {
+			go func() {
+				start := time.Now()
+				res, err := e(ctx)
+				if err == nil {
+					latencies.record(time.Since(start))
+				}
+				results <- result{res, err}
+			}()
+		}
+
+		launch()
+		inFlight, launched := 1, 1
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		var last result
+
+		for {
+			select {
+			case r := <-results:
+				if r.err == nil {
+					return r.res, nil
+				}
+
+				last = r
+				inFlight--
+
+				if launched < opts.MaxAttempts {
+					launch()
+					inFlight, launched = inFlight+1, launched+1
+					timer.Reset(delay)
+				} else if inFlight == 0 {
+					return last.res, last.err
+				}
+
+			case <-timer.C:
+				if launched < opts.MaxAttempts {
+					launch()
+					inFlight, launched = inFlight+1, launched+1
+					timer.Reset(delay)
+				}
+
+			case <-ctx.Done():
+				var zero T
+				return zero, ctx.Err()
+			}
+		}
+	}
+}
+
+// latencyTracker keeps a ring of recent latencies.
+type latencyTracker struct {
+	m       sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (l *latencyTracker) record(d time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if len(l.samples) < cap(l.samples) {
+		l.samples = append(l.samples, d)
+		return
+	}
+
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % len(l.samples)
+}
+
+// percentile returns the latency at percentile p, or def if fewer than
+// minSamples samples have been recorded.
+func (l *latencyTracker) percentile(p float64, minSamples int, def time.Duration) time.Duration {
+	l.m.Lock()
+	sorted := slices.Clone(l.samples)
+	l.m.Unlock()
+
+	if len(sorted) < minSamples || len(sorted) == 0 {
+		return def
+	}
+
+	slices.Sort(sorted)
+
+	i := int(p * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+
+	return sorted[i]
+}
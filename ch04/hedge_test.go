@@ -0,0 +1,131 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestHedgeSlowFirstCall tests that a hedged call is issued when the first
+// is slow, that the fastest result wins, and that the loser is canceled.
+func TestHedgeSlowFirstCall(t *testing.T) {
+	var calls atomic.Int32
+	loserCanceled := make(chan struct{})
+
+	hedged := Hedge(func(ctx context.Context) (string, error) {
+		if calls.Add(1) == 1 {
+			<-ctx.Done() // The slow replica
+			close(loserCanceled)
+			return "", ctx.Err()
+		}
+		return "fast", nil
+	}, HedgeOptions{Delay: 10 * time.Millisecond})
+
+	start := time.Now()
+
+	res, err := hedged(context.Background())
+	if err != nil || res != "fast" {
+		t.Fatalf("expected fast result; got %q, %v", res, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("hedged call took too long:", elapsed)
+	}
+
+	select {
+	case <-loserCanceled:
+	case <-time.After(time.Second):
+		t.Error("slow call was never canceled")
+	}
+}
+
+// TestHedgeFastFirstCall tests that no hedged call is made when the first
+// call returns within the delay.
+func TestHedgeFastFirstCall(t *testing.T) {
+	calls := 0
+
+	hedged := Hedge(countingEffector(&calls, nil), HedgeOptions{Delay: time.Second, MaxAttempts: 3})
+
+	if _, err := hedged(context.Background()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if calls != 1 {
+		t.Error("expected 1 call; got", calls)
+	}
+}
+
+// TestHedgeAllFail tests that failed calls make way for the next attempt
+// immediately, and that the last error is returned when all fail.
+func TestHedgeAllFail(t *testing.T) {
+	var m sync.Mutex
+	calls := 0
+
+	hedged := Hedge(func(ctx context.Context) (string, error) {
+		m.Lock()
+		defer m.Unlock()
+		calls++
+		return "", errors.New("INTENTIONAL FAIL!")
+	}, HedgeOptions{Delay: time.Hour, MaxAttempts: 3})
+
+	if _, err := hedged(context.Background()); err == nil {
+		t.Fatal("expected error; got none")
+	}
+
+	if calls != 3 {
+		t.Error("expected 3 calls; got", calls)
+	}
+}
+
+// TestHedgeContext tests that the caller's context bounds all attempts.
+func TestHedgeContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	hedged := Hedge(func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}, HedgeOptions{Delay: 5 * time.Millisecond, MaxAttempts: 3})
+
+	if _, err := hedged(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected deadline exceeded; got", err)
+	}
+}
+
+// TestLatencyTrackerPercentile tests the latency percentile used to choose
+// the hedging delay.
+func TestLatencyTrackerPercentile(t *testing.T) {
+	l := &latencyTracker{samples: make([]time.Duration, 0, 100)}
+
+	if d := l.percentile(0.9, 10, time.Second); d != time.Second {
+		t.Error("expected default before enough samples; got", d)
+	}
+
+	for i := 1; i <= 200; i++ {
+		l.record(time.Duration(i) * time.Millisecond)
+	}
+
+	// Only the most recent 100 samples, 101ms to 200ms, are kept.
+	if d := l.percentile(0.9, 10, time.Second); d != 191*time.Millisecond {
+		t.Error("expected 191ms; got", d)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// LeakyBucket is a Limiter that smooths calls into an even stream: it
+// grants at most one permit every interval, with no bursts. Callers that
+// Wait or Reserve are queued, and up to capacity of them may be waiting
+// at once; beyond that, reservations aren't OK.
+//
+// A LeakyBucket is safe for concurrent use.
+type LeakyBucket struct {
+	interval time.Duration
+	capacity int
+	clock    Clock
+
+	m    sync.Mutex
+	next time.Time // The earliest time the next permit may be granted
+}
+
+// NewLeakyBucket returns a LeakyBucket that grants rate permits every
+// per, evenly spaced, and queues up to capacity waiting callers.
+func NewLeakyBucket(rate int, per time.Duration, capacity int) *LeakyBucket {
+	return NewLeakyBucketWithClock(rate, per, capacity, systemClock{})
+}
+
+// NewLeakyBucketWithClock returns a LeakyBucket that reads the time from
+// clock.
+func NewLeakyBucketWithClock(rate int, per time.Duration, capacity int, clock Clock) *LeakyBucket {
+	return &LeakyBucket{
+		interval: per / time.Duration(max(rate, 1)),
+		capacity: capacity,
+		clock:    clock,
+	}
+}
+
+// Allow takes a permit if one is available now, without queueing.
+func (b *LeakyBucket) Allow() bool {
+	now := b.clock.Now()
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.next.After(now) {
+		return false
+	}
+
+	b.next = now.Add(b.interval)
+
+	return true
+}
+
+// Reserve queues for the next permit. The Reservation isn't OK if the
+// queue is full.
+func (b *LeakyBucket) Reserve() *Reservation {
+	now := b.clock.Now()
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	at := b.next
+	if at.Before(now) {
+		at = now
+	}
+
+	r := &Reservation{clock: b.clock, at: at, cancel: b.unreserve}
+
+	if at.Sub(now) > time.Duration(b.capacity)*b.interval {
+		return r // Not OK: the queue is full
+	}
+
+	b.next = at.Add(b.interval)
+	r.ok = true
+
+	return r
+}
+
+// unreserve gives up the slot reserved for at. Only the most recently
+// reserved slot can be given back; giving up an earlier one would move
+// the callers queued behind it out of order.
+func (b *LeakyBucket) unreserve(at time.Time) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.next.Equal(at.Add(b.interval)) {
+		b.next = at
+	}
+}
+
+// Wait queues for the next permit, and waits for it.
+func (b *LeakyBucket) Wait(ctx context.Context) error {
+	return waitReservation(ctx, b.Reserve(), nil)
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter is a rate limiter. TokenBucket, LeakyBucket, SlidingWindowLog
+// and SlidingWindowCounter all implement it, so that a throttled effector
+// can swap one algorithm for another without changing its call sites.
+type Limiter interface {
+	// Allow takes a permit if one is available now, and reports whether
+	// it did.
+	Allow() bool
+
+	// Wait takes a permit, waiting until one is available. It returns an
+	// error if the context is done, or its deadline would pass, before
+	// then, or if the limiter can never grant a permit.
+	Wait(ctx context.Context) error
+
+	// Reserve takes a permit that may be used now or in the future, and
+	// returns a Reservation that reports when. The caller should wait for
+	// the Reservation's Delay before acting, or Cancel it.
+	Reserve() *Reservation
+}
+
+// Reservation is a permit reserved by a Limiter.
+type Reservation struct {
+	ok     bool
+	at     time.Time // When the permit may be used
+	clock  Clock
+	cancel func(at time.Time) // Returns the permit to its limiter
+	once   sync.Once
+}
+
+// OK reports whether the limiter could grant the permit at all. If it
+// returns false, the Reservation's other methods are meaningless.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Time returns the time at which the permit may be used.
+func (r *Reservation) Time() time.Time {
+	return r.at
+}
+
+// Delay returns how long to wait before the permit may be used. It's zero
+// if the permit may be used now.
+func (r *Reservation) Delay() time.Duration {
+	return max(r.at.Sub(r.clock.Now()), 0)
+}
+
+// Cancel returns the permit to its limiter, if the time it was reserved
+// for hasn't yet come. It's safe to call more than once.
+func (r *Reservation) Cancel() {
+	if !r.ok || r.cancel == nil {
+		return
+	}
+
+	r.once.Do(func() {
+		if r.clock.Now().Before(r.at) {
+			r.cancel(r.at)
+		}
+	})
+}
+
+// waitReservation waits for r's delay to pass. If r can't be satisfied
+// before ctx's deadline, or ctx or done is closed first, it cancels r and
+// returns an error.
+func waitReservation(ctx context.Context, r *Reservation, done <-chan struct{}) error {
+	if !r.OK() {
+		return ErrTooManyCalls
+	}
+
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		r.Cancel()
+		return context.DeadlineExceeded
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		r.Cancel()
+		return ErrTooManyCalls
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var (
+	_ Limiter = (*TokenBucket)(nil)
+	_ Limiter = (*LeakyBucket)(nil)
+	_ Limiter = (*SlidingWindowLog)(nil)
+	_ Limiter = (*SlidingWindowCounter)(nil)
+)
+
+// TestLimitersAllow tests that each Limiter allows its limit in a burst,
+// or one call if it doesn't permit bursts, and then refuses.
+func TestLimitersAllow(t *testing.T) {
+	clock := newFakeClock()
+
+	tests := []struct {
+		name    string
+		limiter Limiter
+		burst   int
+	}{
+		{"token bucket", NewTokenBucketWithClock(5, 5, time.Minute, clock), 5},
+		{"leaky bucket", NewLeakyBucketWithClock(5, time.Minute, 5, clock), 1},
+		{"sliding window log", NewSlidingWindowLogWithClock(5, time.Minute, clock), 5},
+		{"sliding window counter", NewSlidingWindowCounterWithClock(5, time.Minute, clock), 5},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			n := 0
+			for tc.limiter.Allow() {
+				n++
+				if n > 100 {
+					break
+				}
+			}
+
+			if n != tc.burst {
+				t.Errorf("expected %d; got %d", tc.burst, n)
+			}
+		})
+	}
+}
+
+// TestLimitersThrottleWith tests that any Limiter can be used, unchanged,
+// by a waiting throttled effector.
+func TestLimitersThrottleWith(t *testing.T) {
+	limiters := map[string]Limiter{
+		"token bucket":           NewTokenBucket(1, 1, 20*time.Millisecond),
+		"leaky bucket":           NewLeakyBucket(1, 20*time.Millisecond, 5),
+		"sliding window log":     NewSlidingWindowLog(1, 20*time.Millisecond),
+		"sliding window counter": NewSlidingWindowCounter(1, 20*time.Millisecond),
+	}
+
+	for name, limiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			throttle := ThrottleWith(limiter, callsCountFunction(&calls), true)
+
+			start := time.Now()
+			for i := 0; i < 3; i++ {
+				if _, err := throttle(context.Background()); err != nil {
+					t.Fatal("unexpected error:", err)
+				}
+			}
+
+			if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+				t.Error("expected calls to be spread out; took", elapsed)
+			}
+		})
+	}
+}
+
+// TestTokenBucketReserve tests that reservations borrow against future
+// refills in order, and that cancellation returns the token.
+func TestTokenBucketReserve(t *testing.T) {
+	clock := newFakeClock()
+	bucket := NewTokenBucketWithClock(1, 1, time.Second, clock)
+
+	for i, expected := range []time.Duration{0, time.Second, 2 * time.Second} {
+		r := bucket.Reserve()
+		if !r.OK() || r.Delay() != expected {
+			t.Errorf("reservation %d: expected OK with delay %v; got %v, %v", i, expected, r.OK(), r.Delay())
+		}
+
+		if i == 2 {
+			r.Cancel()
+		}
+	}
+
+	clock.advance(3 * time.Second)
+
+	// Refills at 1s, 2s and 3s pay back the one outstanding reservation,
+	// and the bucket holds at most one token.
+	if !bucket.Allow() || bucket.Allow() {
+		t.Error("expected exactly one token after cancellation")
+	}
+}
+
+// TestLeakyBucketReserve tests that a LeakyBucket spaces reservations
+// evenly and refuses them when its queue is full.
+func TestLeakyBucketReserve(t *testing.T) {
+	clock := newFakeClock()
+	bucket := NewLeakyBucketWithClock(10, time.Second, 2, clock)
+
+	for i := 0; i < 3; i++ {
+		r := bucket.Reserve()
+		if expected := time.Duration(i) * 100 * time.Millisecond; !r.OK() || r.Delay() != expected {
+			t.Errorf("reservation %d: expected OK with delay %v; got %v, %v", i, expected, r.OK(), r.Delay())
+		}
+	}
+
+	if r := bucket.Reserve(); r.OK() {
+		t.Error("expected full queue to refuse reservation; got delay", r.Delay())
+	}
+
+	clock.advance(100 * time.Millisecond)
+
+	r := bucket.Reserve()
+	if !r.OK() || r.Delay() != 200*time.Millisecond {
+		t.Errorf("expected OK with delay 200ms; got %v, %v", r.OK(), r.Delay())
+	}
+
+	r.Cancel()
+
+	if r := bucket.Reserve(); !r.OK() || r.Delay() != 200*time.Millisecond {
+		t.Errorf("expected cancelled slot to be reused; got %v, %v", r.OK(), r.Delay())
+	}
+}
+
+// TestSlidingWindowLog tests that a SlidingWindowLog enforces an exact
+// per-window limit, such as a partner's per-minute quota.
+func TestSlidingWindowLog(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewSlidingWindowLogWithClock(3, time.Minute, clock)
+
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow() {
+			t.Fatal("expected call", i, "to be allowed")
+		}
+		clock.advance(10 * time.Second)
+	}
+
+	if limiter.Allow() {
+		t.Error("expected fourth call in the window to be refused")
+	}
+
+	r := limiter.Reserve()
+	if !r.OK() || r.Delay() != 30*time.Second {
+		t.Errorf("expected reservation when the first call expires; got %v, %v", r.OK(), r.Delay())
+	}
+
+	clock.advance(30 * time.Second)
+
+	// The reservation took the slot freed by the first call.
+	if limiter.Allow() {
+		t.Error("expected reserved slot not to be available")
+	}
+
+	clock.advance(10 * time.Second)
+
+	if !limiter.Allow() {
+		t.Error("expected slot freed by the second call to be available")
+	}
+}
+
+// TestSlidingWindowCounter tests that a SlidingWindowCounter weights the
+// previous fixed window's count by its overlap with the sliding window.
+func TestSlidingWindowCounter(t *testing.T) {
+	clock := newFakeClock() // Starts on a minute boundary
+	limiter := NewSlidingWindowCounterWithClock(10, time.Minute, clock)
+
+	for i := 0; i < 10; i++ {
+		limiter.Allow()
+	}
+
+	// Half way through the next window, the previous one counts for 5.
+	clock.advance(90 * time.Second)
+
+	n := 0
+	for limiter.Allow() {
+		n++
+	}
+
+	if n != 5 {
+		t.Error("expected 5 calls to be allowed; got", n)
+	}
+
+	// The estimate is now 5 + 5; another permit is possible once the
+	// previous window counts for 4, 6 seconds later.
+	r := limiter.Reserve()
+	if !r.OK() || r.Delay() != 6*time.Second {
+		t.Errorf("expected OK with delay 6s; got %v, %v", r.OK(), r.Delay())
+	}
+}
+
+// TestSlidingWindowCounterZeroWindow tests that a SlidingWindowCounter
+// with no window still works, counting permits per nanosecond.
+func TestSlidingWindowCounterZeroWindow(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewSlidingWindowCounterWithClock(2, 0, clock)
+
+	n := 0
+	for i := 0; i < 3; i++ {
+		if limiter.Allow() {
+			n++
+		}
+	}
+
+	if n != 2 {
+		t.Error("expected 2 calls to be allowed; got", n)
+	}
+
+	if r := limiter.Reserve(); !r.OK() || r.Delay() > 2*time.Nanosecond {
+		t.Errorf("expected OK within 2ns; got %v, %v", r.OK(), r.Delay())
+	}
+}
+
+// TestLimiterWaitDeadline tests that Wait gives up immediately if its
+// context's deadline would pass before a permit is available.
+func TestLimiterWaitDeadline(t *testing.T) {
+	limiter := NewSlidingWindowLog(1, time.Hour)
+	limiter.Allow()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	start := time.Now()
+
+	if err := limiter.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected deadline exceeded; got", err)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Error("expected Wait to fail fast")
+	}
+
+	// The cancelled reservation doesn't hold up the next one.
+	if r := limiter.Reserve(); r.Delay() > time.Hour {
+		t.Error("expected cancelled reservation to be released; got delay", r.Delay())
+	}
+}
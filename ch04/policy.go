@@ -0,0 +1,186 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Policy combines the stability patterns in this package into a single
+// reusable wrapper. Layers are added with the With* methods, in any order,
+// but are always applied in this order, from outermost to innermost:
+//
+//	Debounce -> Retry -> Throttle -> Breaker -> Timeout -> effector
+//
+// The order follows from how the layers interact:
+//
+//   - Debounce is outermost, so that callers are coalesced before any of
+//     them consume a retry, a throttle token or a breaker probe.
+//   - Retry is outside the breaker and stops as soon as the breaker
+//     rejects a call with ErrCircuitOpen, rather than retrying a circuit
+//     that is known to be broken.
+//   - Throttle is outside the breaker, so that a rejection by the throttle
+//     is never counted as a downstream failure, and every retry attempt
+//     consumes a token.
+//   - Timeout is innermost, so that each attempt gets its own deadline and
+//     a timed-out attempt counts as a failure towards tripping the breaker.
+//
+// The breaker and the throttle are created once per Policy and shared by
+// every effector the Policy wraps, so a Policy should represent a single
+// downstream dependency. Debouncing is per wrapped effector, since each
+// effector has its own result to share.
+type Policy[T any] struct {
+	debounce     bool
+	debounceOpts DebounceOptions
+
+	retry     bool
+	retryOpts RetryOptions
+
+	throttle     Limiter
+	throttleWait bool
+	breaker      *CircuitBreakerOf[T]
+	timeout      time.Duration
+}
+
+// NewPolicy returns an empty Policy. An empty Policy's Wrap method
+// returns its effector unchanged.
+func NewPolicy[T any]() *Policy[T] {
+	return &Policy[T]{}
+}
+
+// WithDebounce adds a Debounce layer configured by opts. It replaces any
+// debounce layer already added.
+func (p *Policy[T]) WithDebounce(opts DebounceOptions) *Policy[T] {
+	p.debounce, p.debounceOpts = true, opts
+	return p
+}
+
+// WithDebounceFirst adds a DebounceFirst layer. It replaces any debounce
+// layer already added.
+func (p *Policy[T]) WithDebounceFirst(d time.Duration) *Policy[T] {
+	return p.WithDebounce(DebounceOptions{Mode: DebounceLeading, Wait: d, MaxWait: d})
+}
+
+// WithDebounceLast adds a DebounceLast layer. It replaces any debounce
+// layer already added.
+func (p *Policy[T]) WithDebounceLast(d time.Duration) *Policy[T] {
+	return p.WithDebounce(DebounceOptions{Mode: DebounceTrailing, Wait: d})
+}
+
+// WithRetry adds a Retry layer that makes up to retries additional
+// attempts, delay apart. A negative retries means no retries.
+func (p *Policy[T]) WithRetry(retries int, delay time.Duration) *Policy[T] {
+	return p.WithRetryOptions(RetryOptions{Retries: max(retries, 0), Backoff: ConstantBackoff(delay)})
+}
+
+// WithRetryOptions adds a Retry layer configured by opts. Whatever
+// opts.Retryable says, breaker rejections are never retried.
+func (p *Policy[T]) WithRetryOptions(opts RetryOptions) *Policy[T] {
+	p.retry, p.retryOpts = true, opts
+	return p
+}
+
+// WithThrottle adds a Throttle layer with a bucket of max tokens that
+// refills at a rate of refill tokens every d.
+func (p *Policy[T]) WithThrottle(max uint, refill uint, d time.Duration) *Policy[T] {
+	return p.WithLimiter(NewTokenBucket(max, refill, d), false)
+}
+
+// WithLimiter adds a Throttle layer that takes its permits from limiter.
+// If wait is true, calls wait for a permit rather than failing.
+func (p *Policy[T]) WithLimiter(limiter Limiter, wait bool) *Policy[T] {
+	p.throttle, p.throttleWait = limiter, wait
+	return p
+}
+
+// WithBreaker adds a CircuitBreaker layer configured by opts.
+func (p *Policy[T]) WithBreaker(opts BreakerOptions) *Policy[T] {
+	p.breaker = NewCircuitBreakerOf[T](nil, opts)
+	return p
+}
+
+// WithTimeout adds a layer that abandons each attempt after d.
+func (p *Policy[T]) WithTimeout(d time.Duration) *Policy[T] {
+	p.timeout = d
+	return p
+}
+
+// Breaker returns a read-only view of the Policy's shared circuit breaker,
+// so that its state can be inspected. It returns nil if no breaker layer
+// was added.
+func (p *Policy[T]) Breaker() BreakerStatus {
+	if p.breaker == nil {
+		return nil
+	}
+	return p.breaker
+}
+
+// Wrap returns e wrapped in each of the Policy's layers. The layers
+// should all be added before the first call to Wrap.
+func (p *Policy[T]) Wrap(e EffectorOf[T]) EffectorOf[T] {
+	if p.timeout > 0 {
+		e = withTimeout(e, p.timeout)
+	}
+
+	if p.breaker != nil {
+		breaker, next := p.breaker, e
+		e = func(ctx context.Context) (T, error) {
+			return breaker.call(ctx, CircuitOf[T](next))
+		}
+	}
+
+	if p.throttle != nil {
+		e = ThrottleWithOf(p.throttle, e, p.throttleWait)
+	}
+
+	if p.retry {
+		opts := p.retryOpts
+		retryable := opts.Retryable
+		opts.Retryable = func(err error) bool {
+			if errors.Is(err, ErrCircuitOpen) {
+				return false
+			}
+			return retryable == nil || retryable(err)
+		}
+
+		e = RetryWithOptionsOf(e, opts)
+	}
+
+	if p.debounce {
+		e = EffectorOf[T](DebounceOf(CircuitOf[T](e), p.debounceOpts))
+	}
+
+	return e
+}
+
+// withTimeout adapts a context-aware effector to Timeout. Each call is
+// given a context that expires after d, and returns when that context
+// does even if e doesn't respect it.
+func withTimeout[T any](e EffectorOf[T], d time.Duration) EffectorOf[T] {
+	f := TimeoutOf(func(ctx context.Context) (T, error) {
+		return e(ctx)
+	})
+
+	return func(ctx context.Context) (T, error) {
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+
+		return f(ctx, ctx)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingEffector returns an Effector that returns err, and counts how
+// many times it's called.
+func countingEffector(calls *int, err error) Effector {
+	var m sync.Mutex
+
+	return func(ctx context.Context) (string, error) {
+		m.Lock()
+		*calls++
+		m.Unlock()
+
+		if err != nil {
+			return "", err
+		}
+		return "Success", nil
+	}
+}
+
+// TestPolicyEmpty tests that an empty Policy doesn't change its effector.
+func TestPolicyEmpty(t *testing.T) {
+	calls := 0
+	e := NewPolicy[string]().Wrap(countingEffector(&calls, nil))
+
+	res, err := e(context.Background())
+	if err != nil || res != "Success" || calls != 1 {
+		t.Errorf("unexpected result: %q, %v after %d calls", res, err, calls)
+	}
+}
+
+// TestPolicyBreakerStatus tests that a Policy's breaker can be inspected,
+// and that Breaker returns nil without a breaker layer.
+func TestPolicyBreakerStatus(t *testing.T) {
+	if b := NewPolicy[string]().Breaker(); b != nil {
+		t.Error("expected no breaker; got", b)
+	}
+
+	b := NewPolicy[string]().WithBreaker(BreakerOptions{}).Breaker()
+	if b == nil || b.State() != StateClosed || b.Counts().Requests != 0 {
+		t.Error("expected a closed breaker with no requests; got", b)
+	}
+}
+
+// TestPolicyRetryNegative tests that WithRetry with negative retries makes
+// a single attempt.
+func TestPolicyRetryNegative(t *testing.T) {
+	calls := 0
+	e := NewPolicy[string]().
+		WithRetry(-1, time.Millisecond).
+		Wrap(countingEffector(&calls, errors.New("error")))
+
+	if _, err := e(context.Background()); err == nil {
+		t.Error("expected an error")
+	}
+
+	if calls != 1 {
+		t.Error("expected 1 call; got", calls)
+	}
+}
+
+// TestPolicyRetryStopsAtOpenBreaker tests that retries stop as soon as the
+// breaker opens, rather than being spent against an open circuit.
+func TestPolicyRetryStopsAtOpenBreaker(t *testing.T) {
+	calls := 0
+
+	policy := NewPolicy[string]().
+		WithRetry(5, time.Millisecond).
+		WithBreaker(BreakerOptions{ShouldTrip: ConsecutiveFailures(2), Clock: newFakeClock()})
+
+	_, err := policy.Wrap(countingEffector(&calls, errors.New("INTENTIONAL FAIL!")))(context.Background())
+
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Error("expected ErrCircuitOpen; got", err)
+	}
+
+	if calls != 2 {
+		t.Error("expected 2 calls before the breaker opened; got", calls)
+	}
+}
+
+// TestPolicyThrottleDoesNotTripBreaker tests that throttle rejections
+// aren't counted as failures by the breaker.
+func TestPolicyThrottleDoesNotTripBreaker(t *testing.T) {
+	calls := 0
+
+	policy := NewPolicy[string]().
+		WithBreaker(BreakerOptions{ShouldTrip: ConsecutiveFailures(1), Clock: newFakeClock()}).
+		WithThrottle(1, 1, time.Hour)
+
+	e := policy.Wrap(countingEffector(&calls, nil))
+
+	for i := 0; i < 5; i++ {
+		e(context.Background())
+	}
+
+	if calls != 1 {
+		t.Error("expected 1 call; got", calls)
+	}
+
+	if s := policy.Breaker().State(); s != StateClosed {
+		t.Error("expected breaker to remain closed; got", s)
+	}
+}
+
+// TestPolicyTimeoutTripsBreaker tests that each attempt has its own
+// deadline, and that a timed-out attempt counts as a breaker failure.
+func TestPolicyTimeoutTripsBreaker(t *testing.T) {
+	policy := NewPolicy[string]().
+		WithBreaker(BreakerOptions{ShouldTrip: ConsecutiveFailures(1), Clock: newFakeClock()}).
+		WithTimeout(10 * time.Millisecond)
+
+	e := policy.Wrap(func(ctx context.Context) (string, error) {
+		time.Sleep(time.Second)
+		return "Success", nil
+	})
+
+	start := time.Now()
+
+	if _, err := e(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected deadline exceeded; got", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("timeout took too long:", elapsed)
+	}
+
+	if s := policy.Breaker().State(); s != StateOpen {
+		t.Error("expected breaker to be open; got", s)
+	}
+}
+
+// TestPolicySharedBreaker tests that effectors wrapped by the same Policy
+// share its breaker.
+func TestPolicySharedBreaker(t *testing.T) {
+	failing, healthy := 0, 0
+
+	policy := NewPolicy[string]().
+		WithBreaker(BreakerOptions{ShouldTrip: ConsecutiveFailures(1), Clock: newFakeClock()})
+
+	policy.Wrap(countingEffector(&failing, errors.New("INTENTIONAL FAIL!")))(context.Background())
+
+	_, err := policy.Wrap(countingEffector(&healthy, nil))(context.Background())
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Error("expected ErrCircuitOpen; got", err)
+	}
+
+	if healthy != 0 {
+		t.Error("expected healthy effector not to be called; got", healthy)
+	}
+}
+
+// TestPolicyDebounceCoalescesRetries tests that debounced callers share a
+// single, retried, call.
+func TestPolicyDebounceCoalescesRetries(t *testing.T) {
+	calls := 0
+	attempts := 0
+
+	e := NewPolicy[string]().
+		WithDebounceFirst(time.Minute).
+		WithRetry(3, time.Millisecond).
+		Wrap(func(ctx context.Context) (string, error) {
+			attempts++
+			if attempts < 2 {
+				return "", errors.New("INTENTIONAL FAIL!")
+			}
+			calls++
+			return "Success", nil
+		})
+
+	for i := 0; i < 5; i++ {
+		if res, err := e(context.Background()); err != nil || res != "Success" {
+			t.Fatalf("unexpected result: %q, %v", res, err)
+		}
+	}
+
+	if attempts != 2 || calls != 1 {
+		t.Errorf("expected 2 attempts and 1 success; got %d and %d", attempts, calls)
+	}
+}
@@ -0,0 +1,280 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+var (
+	// ErrPanicked is matched by the error of a Promise whose function
+	// panicked.
+	ErrPanicked = errors.New("function panicked")
+
+	// ErrNoResult is returned by Any when none of its futures succeed, and
+	// by Any and Race when given no futures.
+	ErrNoResult = errors.New("no future succeeded")
+)
+
+// PanicError is the error of a Promise whose function panicked. It holds
+// the value passed to panic and the stack at the time. It matches
+// ErrPanicked when tested with errors.Is, and unwraps to the panic value
+// if that's an error.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrPanicked, e.Value)
+}
+
+func (e *PanicError) Is(target error) bool {
+	return target == ErrPanicked
+}
+
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// Promise is a FutureOf[T] whose result is provided by a function running
+// in its own goroutine. A Promise settles when its function returns or
+// panics, or when its context is done, whichever comes first.
+type Promise[T any] struct {
+	once   sync.Once
+	done   chan struct{}
+	res    T
+	err    error
+	cancel context.CancelFunc
+}
+
+// NewPromise calls f in a new goroutine and returns a Promise of its
+// result. The context passed to f is derived from ctx, and is canceled
+// once the Promise settles or is canceled. If f panics, the Promise's
+// error is a *PanicError.
+func NewPromise[T any](ctx context.Context, f func(context.Context) (T, error)) *Promise[T] {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &Promise[T]{done: make(chan struct{}), cancel: cancel}
+
+	// Settle as soon as ctx is done, even if f doesn't return.
+	stop := context.AfterFunc(ctx, func() {
+		var zero T
+		p.settle(zero, ctx.Err())
+	})
+
+	go func() {
+		defer stop()
+		defer func() {
+			if r := recover(); r != nil {
+				var zero T
+				p.settle(zero, &PanicError{Value: r, Stack: debug.Stack()})
+			}
+		}()
+
+		res, err := f(ctx)
+		p.settle(res, err)
+	}()
+
+	return p
+}
+
+// Resolved returns a Promise that's already settled with res.
+func Resolved[T any](res T) *Promise[T] {
+	p := &Promise[T]{done: make(chan struct{}), cancel: func() {}}
+	p.settle(res, nil)
+	return p
+}
+
+// Rejected returns a Promise that's already settled with err.
+func Rejected[T any](err error) *Promise[T] {
+	var zero T
+	p := &Promise[T]{done: make(chan struct{}), cancel: func() {}}
+	p.settle(zero, err)
+	return p
+}
+
+// settle sets the Promise's result. Only the first call has any effect.
+func (p *Promise[T]) settle(res T, err error) {
+	p.once.Do(func() {
+		p.res, p.err = res, err
+		close(p.done)
+		p.cancel()
+	})
+}
+
+// Result blocks until the Promise settles, and then returns its result.
+func (p *Promise[T]) Result() (T, error) {
+	<-p.done
+	return p.res, p.err
+}
+
+// ResultContext is like Result, but stops waiting and returns ctx.Err()
+// if ctx is done first. The Promise itself is unaffected.
+func (p *Promise[T]) ResultContext(ctx context.Context) (T, error) {
+	select {
+	case <-p.done:
+		return p.res, p.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// Done returns a channel that's closed when the Promise settles.
+func (p *Promise[T]) Done() <-chan struct{} {
+	return p.done
+}
+
+// Cancel cancels the Promise's context. If it hasn't already settled, the
+// Promise settles immediately with context.Canceled.
+func (p *Promise[T]) Cancel() {
+	p.cancel()
+}
+
+// await waits for f's result or for ctx to be done. A FutureOf that isn't a
+// Promise is waited for in a new goroutine, which lingers until it settles.
+func await[T any](ctx context.Context, f FutureOf[T]) (T, error) {
+	if p, ok := f.(*Promise[T]); ok {
+		return p.ResultContext(ctx)
+	}
+
+	return NewPromise(ctx, func(context.Context) (T, error) {
+		return f.Result()
+	}).Result()
+}
+
+// cancelAll cancels every future in fs that can be canceled.
+func cancelAll[T any](fs []FutureOf[T]) {
+	for _, f := range fs {
+		if c, ok := f.(interface{ Cancel() }); ok {
+			c.Cancel()
+		}
+	}
+}
+
+// Then returns a Promise of the result of calling fn with f's result, once
+// f succeeds. If f fails, fn isn't called and the Promise fails with f's
+// error.
+func Then[T, U any](ctx context.Context, f FutureOf[T], fn func(context.Context, T) (U, error)) *Promise[U] {
+	return NewPromise(ctx, func(ctx context.Context) (U, error) {
+		res, err := await(ctx, f)
+		if err != nil {
+			var zero U
+			return zero, err
+		}
+
+		return fn(ctx, res)
+	})
+}
+
+// Map is like Then, for functions that can't fail.
+func Map[T, U any](ctx context.Context, f FutureOf[T], fn func(T) U) *Promise[U] {
+	return Then(ctx, f, func(_ context.Context, res T) (U, error) {
+		return fn(res), nil
+	})
+}
+
+// All returns a Promise of the results of every future in fs, in order.
+// It fails with the first error from any of them, in which case the rest
+// are canceled.
+func All[T any](ctx context.Context, fs ...FutureOf[T]) *Promise[[]T] {
+	return NewPromise(ctx, func(ctx context.Context) ([]T, error) {
+		type indexed struct {
+			i   int
+			res T
+			err error
+		}
+
+		ch := make(chan indexed, len(fs))
+
+		for i, f := range fs {
+			go func() {
+				res, err := await(ctx, f)
+				ch <- indexed{i, res, err}
+			}()
+		}
+
+		results := make([]T, len(fs))
+
+		for range fs {
+			r := <-ch
+			if r.err != nil {
+				cancelAll(fs)
+				return nil, r.err
+			}
+			results[r.i] = r.res
+		}
+
+		return results, nil
+	})
+}
+
+// Any returns a Promise of the result of the first future in fs to
+// succeed, and cancels the rest. If none succeed, it fails with an error
+// that matches ErrNoResult and each of their errors.
+func Any[T any](ctx context.Context, fs ...FutureOf[T]) *Promise[T] {
+	return first(ctx, fs, false)
+}
+
+// Race returns a Promise of the result of the first future in fs to
+// settle, whether it succeeds or fails, and cancels the rest.
+func Race[T any](ctx context.Context, fs ...FutureOf[T]) *Promise[T] {
+	return first(ctx, fs, true)
+}
+
+// first implements Any and Race.
+func first[T any](ctx context.Context, fs []FutureOf[T], settleOnError bool) *Promise[T] {
+	return NewPromise(ctx, func(ctx context.Context) (T, error) {
+		var zero T
+
+		if len(fs) == 0 {
+			return zero, ErrNoResult
+		}
+
+		type result struct {
+			res T
+			err error
+		}
+
+		ch := make(chan result, len(fs))
+
+		for _, f := range fs {
+			go func() {
+				res, err := await(ctx, f)
+				ch <- result{res, err}
+			}()
+		}
+
+		var errs []error
+
+		for range fs {
+			r := <-ch
+			if r.err == nil || settleOnError {
+				cancelAll(fs)
+				return r.res, r.err
+			}
+			errs = append(errs, r.err)
+		}
+
+		return zero, fmt.Errorf("%w: %w", ErrNoResult, errors.Join(errs...))
+	})
+}
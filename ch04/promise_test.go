@@ -0,0 +1,236 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// sleepy returns a function that returns res, err after d, or ctx.Err()
+// if its context is done first.
+func sleepy[T any](d time.Duration, res T, err error) func(context.Context) (T, error) {
+	return func(ctx context.Context) (T, error) {
+		select {
+		case <-time.After(d):
+			return res, err
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		}
+	}
+}
+
+// TestPromise tests that a Promise returns its function's result, and that
+// it can be read more than once.
+func TestPromise(t *testing.T) {
+	p := NewPromise(context.Background(), sleepy(10*time.Millisecond, 42, nil))
+
+	for i := 0; i < 2; i++ {
+		if res, err := p.Result(); res != 42 || err != nil {
+			t.Errorf("expected 42, nil; got %d, %v", res, err)
+		}
+	}
+
+	select {
+	case <-p.Done():
+	default:
+		t.Error("expected Done to be closed")
+	}
+}
+
+// TestPromisePanic tests that a panic becomes a *PanicError.
+func TestPromisePanic(t *testing.T) {
+	cause := errors.New("INTENTIONAL PANIC!")
+
+	p := NewPromise(context.Background(), func(context.Context) (int, error) {
+		panic(cause)
+	})
+
+	_, err := p.Result()
+
+	var pe *PanicError
+	if !errors.As(err, &pe) || len(pe.Stack) == 0 {
+		t.Fatal("expected a PanicError with a stack; got", err)
+	}
+
+	if !errors.Is(err, ErrPanicked) || !errors.Is(err, cause) {
+		t.Error("expected error to match ErrPanicked and the panic value; got", err)
+	}
+}
+
+// TestPromiseCancel tests that a canceled Promise settles straightaway,
+// even if its function ignores its context.
+func TestPromiseCancel(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	p := NewPromise(context.Background(), func(context.Context) (int, error) {
+		<-release
+		return 42, nil
+	})
+
+	p.Cancel()
+
+	if _, err := p.Result(); !errors.Is(err, context.Canceled) {
+		t.Error("expected context canceled; got", err)
+	}
+}
+
+// TestPromiseResultContext tests that a caller can stop waiting without
+// affecting the Promise.
+func TestPromiseResultContext(t *testing.T) {
+	p := NewPromise(context.Background(), sleepy(50*time.Millisecond, 42, nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := p.ResultContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected deadline exceeded; got", err)
+	}
+
+	if res, err := p.Result(); res != 42 || err != nil {
+		t.Errorf("expected 42, nil; got %d, %v", res, err)
+	}
+}
+
+// TestThenMap tests chaining, and that a failure skips the rest of the
+// chain.
+func TestThenMap(t *testing.T) {
+	ctx := context.Background()
+
+	p := Map(ctx, Then(ctx, Resolved(20), func(_ context.Context, n int) (int, error) {
+		return n + 1, nil
+	}), func(n int) string {
+		return string(rune('A' + n))
+	})
+
+	if res, err := p.Result(); res != "V" || err != nil {
+		t.Errorf("expected V, nil; got %q, %v", res, err)
+	}
+
+	cause := errors.New("INTENTIONAL FAIL!")
+	called := false
+
+	q := Map(ctx, Rejected[int](cause), func(n int) int {
+		called = true
+		return n
+	})
+
+	if _, err := q.Result(); !errors.Is(err, cause) || called {
+		t.Errorf("expected %v without calling fn; got %v, called=%v", cause, err, called)
+	}
+}
+
+// TestThenInnerFuture tests that the combinators accept any FutureOf.
+func TestThenInnerFuture(t *testing.T) {
+	resCh := make(chan int)
+	errCh := make(chan error)
+
+	go func() {
+		resCh <- 41
+		errCh <- nil
+	}()
+
+	f := &InnerFutureOf[int]{resCh: resCh, errCh: errCh}
+
+	p := Map(context.Background(), f, func(n int) int { return n + 1 })
+
+	if res, err := p.Result(); res != 42 || err != nil {
+		t.Errorf("expected 42, nil; got %d, %v", res, err)
+	}
+}
+
+// TestAll tests that All returns results in order, and that a failure
+// cancels the remaining futures.
+func TestAll(t *testing.T) {
+	ctx := context.Background()
+
+	p := All[int](ctx,
+		NewPromise(ctx, sleepy(30*time.Millisecond, 1, nil)),
+		NewPromise(ctx, sleepy(10*time.Millisecond, 2, nil)),
+		Resolved(3))
+
+	res, err := p.Result()
+	if err != nil || len(res) != 3 || res[0] != 1 || res[1] != 2 || res[2] != 3 {
+		t.Errorf("expected [1 2 3], nil; got %v, %v", res, err)
+	}
+
+	cause := errors.New("INTENTIONAL FAIL!")
+	slow := NewPromise(ctx, sleepy(time.Second, 1, nil))
+
+	start := time.Now()
+	_, err = All[int](ctx, slow, NewPromise(ctx, sleepy(10*time.Millisecond, 0, cause))).Result()
+
+	if !errors.Is(err, cause) || time.Since(start) > 500*time.Millisecond {
+		t.Error("expected to fail fast with", cause, "; got", err)
+	}
+
+	if _, err := slow.Result(); !errors.Is(err, context.Canceled) {
+		t.Error("expected slow future to be canceled; got", err)
+	}
+}
+
+// TestAny tests that Any returns the first success, and reports every
+// error if there's none.
+func TestAny(t *testing.T) {
+	ctx := context.Background()
+	cause := errors.New("INTENTIONAL FAIL!")
+
+	slow := NewPromise(ctx, sleepy(time.Second, 1, nil))
+
+	p := Any[int](ctx,
+		slow,
+		NewPromise(ctx, sleepy(20*time.Millisecond, 2, nil)),
+		Rejected[int](cause))
+
+	if res, err := p.Result(); res != 2 || err != nil {
+		t.Errorf("expected 2, nil; got %d, %v", res, err)
+	}
+
+	if _, err := slow.Result(); !errors.Is(err, context.Canceled) {
+		t.Error("expected loser to be canceled; got", err)
+	}
+
+	other := errors.New("ANOTHER INTENTIONAL FAIL!")
+	_, err := Any[int](ctx, Rejected[int](cause), Rejected[int](other)).Result()
+
+	if !errors.Is(err, ErrNoResult) || !errors.Is(err, cause) || !errors.Is(err, other) {
+		t.Error("expected error to match ErrNoResult and both causes; got", err)
+	}
+
+	if _, err := Any[int](ctx).Result(); !errors.Is(err, ErrNoResult) {
+		t.Error("expected ErrNoResult; got", err)
+	}
+}
+
+// TestRace tests that Race returns the first future to settle, even if
+// it fails.
+func TestRace(t *testing.T) {
+	ctx := context.Background()
+	cause := errors.New("INTENTIONAL FAIL!")
+
+	p := Race[int](ctx,
+		NewPromise(ctx, sleepy(time.Second, 1, nil)),
+		NewPromise(ctx, sleepy(10*time.Millisecond, 0, cause)))
+
+	if _, err := p.Result(); !errors.Is(err, cause) {
+		t.Error("expected", cause, "; got", err)
+	}
+}
@@ -18,24 +18,110 @@ package ch04
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"time"
 )
 
 func Retry(effector Effector, retries int, delay time.Duration) Effector {
-	return func(ctx context.Context) (string, error) {
+	return RetryOf(effector, retries, delay)
+}
+
+// RetryOf is the generic form of Retry. Unlike RetryOptions.Retries, a
+// negative retries means no retries.
+func RetryOf[T any](effector EffectorOf[T], retries int, delay time.Duration) EffectorOf[T] {
+	return RetryWithOptionsOf(effector, RetryOptions{
+		Retries: max(retries, 0),
+		Backoff: ConstantBackoff(delay),
+		OnRetry: func(attempt int, err error, delay time.Duration) {
+			log.Printf("Attempt %d failed; retrying in %v", attempt, delay)
+		},
+	})
+}
+
+// RetryOptions configures RetryWithOptions.
+type RetryOptions struct {
+	// Retries is the maximum number of retries after the first attempt.
+	// If negative, the number of retries is limited only by MaxElapsedTime
+	// and the context.
+	Retries int
+
+	// Backoff computes the delay before each retry. Defaults to
+	// FullJitterBackoff(100*time.Millisecond, 10*time.Second).
+	Backoff Backoff
+
+	// MaxElapsedTime, if positive, bounds the total time spent retrying.
+	// A retry is not attempted if its delay would take the time since the
+	// first attempt past MaxElapsedTime.
+	MaxElapsedTime time.Duration
+
+	// Retryable reports whether an error is worth retrying. Errors for
+	// which it returns false are returned immediately. Defaults to
+	// retrying all errors.
+	Retryable func(err error) bool
+
+	// Budget, if set, is a RetryBudget shared with other effectors. Each
+	// successful call makes a deposit and each retry a withdrawal. When
+	// the budget is exhausted, the last error is returned wrapped with
+	// ErrRetryBudgetExhausted.
+	Budget *RetryBudget
+
+	// OnRetry, if set, is called before each retry with the number of the
+	// attempt that failed, its error, and the delay before the next one.
+	OnRetry func(attempt int, err error, delay time.Duration)
+}
+
+// RetryWithOptions returns an Effector that calls effector, retrying
+// failed calls as configured by opts.
+func RetryWithOptions(effector Effector, opts RetryOptions) Effector {
+	return RetryWithOptionsOf(effector, opts)
+}
+
+// RetryWithOptionsOf is the generic form of RetryWithOptions.
+func RetryWithOptionsOf[T any](effector EffectorOf[T], opts RetryOptions) EffectorOf[T] {
+	if opts.Backoff == nil {
+		opts.Backoff = FullJitterBackoff(100*time.Millisecond, 10*time.Second)
+	}
+	if opts.Retryable == nil {
+		opts.Retryable = func(error) bool { return true }
+	}
+
+	return func(ctx context.Context) (T, error) {
+		var delay time.Duration
+		start := time.Now()
+
 		for r := 0; ; r++ {
 			response, err := effector(ctx)
-			if err == nil || r >= retries {
+			if err == nil && opts.Budget != nil {
+				opts.Budget.Deposit()
+			}
+
+			if err == nil || (opts.Retries >= 0 && r >= opts.Retries) || !opts.Retryable(err) {
 				return response, err
 			}
 
-			log.Printf("Attempt %d failed; retrying in %v", r+1, delay)
+			delay = opts.Backoff(r+1, delay)
+
+			if opts.MaxElapsedTime > 0 && time.Since(start)+delay > opts.MaxElapsedTime {
+				return response, err
+			}
+
+			if opts.Budget != nil && !opts.Budget.TryWithdraw() {
+				return response, fmt.Errorf("%w: %w", ErrRetryBudgetExhausted, err)
+			}
+
+			if opts.OnRetry != nil {
+				opts.OnRetry(r+1, err, delay)
+			}
+
+			timer := time.NewTimer(delay)
 
 			select {
-			case <-time.After(delay):
+			case <-timer.C:
 			case <-ctx.Done():
-				return "", ctx.Err()
+				timer.Stop()
+				var zero T
+				return zero, ctx.Err()
 			}
 		}
 	}
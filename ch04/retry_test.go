@@ -43,3 +43,119 @@ func TestRetry(t *testing.T) {
 
 	fmt.Println(res, err)
 }
+
+// TestRetryOfBytes tests RetryOf with an effector that returns a byte slice.
+func TestRetryOfBytes(t *testing.T) {
+	attempts := 0
+	effector := func(ctx context.Context) ([]byte, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("error")
+		}
+		return []byte("success"), nil
+	}
+
+	res, err := RetryOf(effector, 5, time.Millisecond)(context.Background())
+	if err != nil || string(res) != "success" {
+		t.Errorf("expected success; got %q, %v", res, err)
+	}
+
+	if attempts != 3 {
+		t.Error("expected 3 attempts; got", attempts)
+	}
+}
+
+// TestRetryNegative tests that Retry with negative retries makes a single
+// attempt.
+func TestRetryNegative(t *testing.T) {
+	attempts := 0
+	effector := func(ctx context.Context) (string, error) {
+		attempts++
+		return "", errors.New("error")
+	}
+
+	if _, err := Retry(effector, -1, time.Millisecond)(context.Background()); err == nil {
+		t.Error("expected an error")
+	}
+
+	if attempts != 1 {
+		t.Error("expected 1 attempt; got", attempts)
+	}
+}
+
+// TestRetryWithOptionsRetryable tests that errors that aren't retryable
+// are returned immediately.
+func TestRetryWithOptionsRetryable(t *testing.T) {
+	permanent := errors.New("permanent")
+	attempts := 0
+
+	r := RetryWithOptions(func(ctx context.Context) (string, error) {
+		attempts++
+		return "", permanent
+	}, RetryOptions{
+		Retries:   5,
+		Backoff:   ConstantBackoff(time.Millisecond),
+		Retryable: func(err error) bool { return !errors.Is(err, permanent) },
+	})
+
+	if _, err := r(context.Background()); !errors.Is(err, permanent) {
+		t.Error("expected permanent error; got", err)
+	}
+
+	if attempts != 1 {
+		t.Error("expected 1 attempt; got", attempts)
+	}
+}
+
+// TestRetryWithOptionsMaxElapsedTime tests that retrying stops once the
+// next delay would exceed MaxElapsedTime, and that OnRetry is called
+// before each retry.
+func TestRetryWithOptionsMaxElapsedTime(t *testing.T) {
+	attempts := 0
+	var delays []time.Duration
+
+	r := RetryWithOptions(func(ctx context.Context) (string, error) {
+		attempts++
+		return "", errors.New("error")
+	}, RetryOptions{
+		Retries:        -1,
+		Backoff:        ExponentialBackoff(10*time.Millisecond, time.Second),
+		MaxElapsedTime: 100 * time.Millisecond,
+		OnRetry: func(attempt int, err error, delay time.Duration) {
+			if attempt != len(delays)+1 {
+				t.Errorf("expected attempt %d; got %d", len(delays)+1, attempt)
+			}
+			delays = append(delays, delay)
+		},
+	})
+
+	start := time.Now()
+
+	if _, err := r(context.Background()); err == nil {
+		t.Error("expected error; got none")
+	}
+
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Error("retried past MaxElapsedTime:", elapsed)
+	}
+
+	// 10ms + 20ms + 40ms = 70ms; another 80ms would exceed 100ms.
+	if attempts != 4 || len(delays) != 3 {
+		t.Errorf("expected 4 attempts and 3 retries; got %d and %d", attempts, len(delays))
+	}
+}
+
+// TestRetryWithOptionsContext tests that a canceled context interrupts
+// the delay between retries.
+func TestRetryWithOptionsContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	r := RetryWithOptions(func(ctx context.Context) (string, error) {
+		return "", errors.New("error")
+	}, RetryOptions{Retries: -1, Backoff: ConstantBackoff(time.Hour)})
+
+	if _, err := r(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected deadline exceeded; got", err)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRetryBudgetExhausted is returned, wrapped together with the error of
+// the last attempt, when a retry is suppressed by a RetryBudget.
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// RetryBudgetOptions configures a RetryBudget.
+type RetryBudgetOptions struct {
+	// Ratio is the number of retries earned by each successful request.
+	// A Ratio of 0.1 allows retries to add at most 10% to the load on a
+	// dependency, once the initial tokens have been spent. Defaults to 0.1.
+	Ratio float64
+
+	// MinRetriesPerSecond is the rate at which tokens are refilled over
+	// time, regardless of traffic, so that low-traffic callers can still
+	// retry. Defaults to zero.
+	MinRetriesPerSecond float64
+
+	// MaxTokens caps the number of retries that can be banked. A budget
+	// starts full. Defaults to 10.
+	MaxTokens float64
+
+	// Clock provides the current time. Defaults to the system clock.
+	Clock Clock
+}
+
+// RetryBudget limits retries across every effector that shares it, as a
+// ratio of retries to successful requests. Unlike a per-call retry limit,
+// a budget stops retries from multiplying the load on a dependency that's
+// failing for everyone. A RetryBudget is safe for concurrent use.
+type RetryBudget struct {
+	opts RetryBudgetOptions
+
+	m      sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRetryBudget returns a full RetryBudget configured by opts.
+func NewRetryBudget(opts RetryBudgetOptions) *RetryBudget {
+	if opts.Ratio <= 0 {
+		opts.Ratio = 0.1
+	}
+	if opts.MaxTokens <= 0 {
+		opts.MaxTokens = 10
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+
+	return &RetryBudget{
+		opts:   opts,
+		tokens: opts.MaxTokens,
+		last:   opts.Clock.Now(),
+	}
+}
+
+// Deposit records a successful request, earning Ratio tokens.
+func (b *RetryBudget) Deposit() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.refill()
+	b.tokens = min(b.tokens+b.opts.Ratio, b.opts.MaxTokens)
+}
+
+// TryWithdraw spends a token for a retry. It returns false, and spends
+// nothing, if a whole token isn't available.
+func (b *RetryBudget) TryWithdraw() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.refill()
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// Available returns the number of retries the budget currently allows.
+func (b *RetryBudget) Available() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.refill()
+
+	return int(b.tokens)
+}
+
+// refill adds the tokens earned by the passage of time since the last
+// refill. Must be called with b.m held.
+func (b *RetryBudget) refill() {
+	now := b.opts.Clock.Now()
+	elapsed := now.Sub(b.last)
+	b.last = now
+
+	if elapsed > 0 && b.opts.MinRetriesPerSecond > 0 {
+		b.tokens = min(b.tokens+elapsed.Seconds()*b.opts.MinRetriesPerSecond, b.opts.MaxTokens)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestRetryBudgetShared tests that effectors sharing a budget stop
+// retrying once it's exhausted, and return a distinguishable error.
+func TestRetryBudgetShared(t *testing.T) {
+	intentional := errors.New("INTENTIONAL FAIL!")
+	budget := NewRetryBudget(RetryBudgetOptions{MaxTokens: 3, Clock: newFakeClock()})
+	opts := RetryOptions{Retries: 10, Backoff: ConstantBackoff(0), Budget: budget}
+
+	calls1, calls2 := 0, 0
+	r1 := RetryWithOptions(countingEffector(&calls1, intentional), opts)
+	r2 := RetryWithOptions(countingEffector(&calls2, intentional), opts)
+
+	_, err := r1(context.Background())
+	if !errors.Is(err, ErrRetryBudgetExhausted) || !errors.Is(err, intentional) {
+		t.Error("expected exhausted budget wrapping last error; got", err)
+	}
+
+	_, err = r2(context.Background())
+	if !errors.Is(err, ErrRetryBudgetExhausted) {
+		t.Error("expected exhausted budget; got", err)
+	}
+
+	// The first effector gets the 3 banked retries; the second gets none.
+	if calls1 != 4 || calls2 != 1 {
+		t.Errorf("expected 4 and 1 calls; got %d and %d", calls1, calls2)
+	}
+}
+
+// TestRetryBudgetDeposit tests that successful requests earn retries at
+// the configured ratio.
+func TestRetryBudgetDeposit(t *testing.T) {
+	budget := NewRetryBudget(RetryBudgetOptions{Ratio: 0.5, MaxTokens: 2, Clock: newFakeClock()})
+
+	for budget.TryWithdraw() {
+	}
+
+	budget.Deposit()
+	if budget.Available() != 0 {
+		t.Error("expected 0 retries after 1 deposit; got", budget.Available())
+	}
+
+	budget.Deposit()
+	if budget.Available() != 1 {
+		t.Error("expected 1 retry after 2 deposits; got", budget.Available())
+	}
+
+	for i := 0; i < 10; i++ {
+		budget.Deposit()
+	}
+	if budget.Available() != 2 {
+		t.Error("expected budget to be capped at 2; got", budget.Available())
+	}
+}
+
+// TestRetryBudgetRefill tests that tokens are refilled over time.
+func TestRetryBudgetRefill(t *testing.T) {
+	clock := newFakeClock()
+	budget := NewRetryBudget(RetryBudgetOptions{MinRetriesPerSecond: 2, MaxTokens: 5, Clock: clock})
+
+	for budget.TryWithdraw() {
+	}
+
+	clock.advance(time.Second)
+	if budget.Available() != 2 {
+		t.Error("expected 2 retries after 1 second; got", budget.Available())
+	}
+
+	clock.advance(time.Minute)
+	if budget.Available() != 5 {
+		t.Error("expected budget to be capped at 5; got", budget.Available())
+	}
+}
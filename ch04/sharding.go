@@ -17,99 +17,408 @@
 package ch04
 
 import (
-	"hash/fnv"
-	"reflect"
+	"iter"
+	"maps"
+	"slices"
 	"sync"
+	"sync/atomic"
 )
 
 type Shard[K comparable, V any] struct {
 	sync.RWMutex         // Compose from sync.RWMutex
 	items        map[K]V // m contains the shard's data
+	retired      bool    // Set once a Reshard has replaced the shard
 }
 
-type ShardedMap[K comparable, V any] []*Shard[K, V]
+// ShardedMapOptions configures a ShardedMap.
+type ShardedMapOptions[K comparable] struct {
+	// Shards is the initial number of shards. Defaults to 1.
+	Shards int
+
+	// Hasher hashes keys. Defaults to DefaultHasher.
+	Hasher Hasher[K]
+
+	// Strategy maps hashes to shards. Defaults to ModuloSharding.
+	Strategy ShardingStrategy
+
+	// VirtualNodes is the number of nodes per shard on a RingSharding
+	// map's hash ring. Defaults to 100.
+	VirtualNodes int
+}
+
+// ShardedMap is a map that's split into a number of shards, each guarded
+// by its own lock, so that operations on keys in different shards don't
+// contend with each other.
+type ShardedMap[K comparable, V any] struct {
+	opts   ShardedMapOptions[K]
+	layout atomic.Pointer[shardLayout[K, V]]
+	resize sync.RWMutex // Held by Reshard, and read-held by whole-map operations
+}
+
+// shardLayout is a ShardedMap's set of shards. It's replaced as a whole by
+// Reshard.
+type shardLayout[K comparable, V any] struct {
+	shards   []*Shard[K, V]
+	strategy ShardingStrategy
+	ring     hashRing // RingSharding only
+}
 
 // NewShardedMap creates and initializes a new ShardedMap with the specified
 // number of shards.
-func NewShardedMap[K comparable, V any](nshards int) ShardedMap[K, V] {
-	shards := make([]*Shard[K, V], nshards) // Initialize a *Shards slice
+func NewShardedMap[K comparable, V any](nshards int) *ShardedMap[K, V] {
+	return NewShardedMapWithOptions[K, V](ShardedMapOptions[K]{Shards: nshards})
+}
+
+// NewShardedMapWithOptions creates and initializes a new ShardedMap
+// configured by opts.
+func NewShardedMapWithOptions[K comparable, V any](opts ShardedMapOptions[K]) *ShardedMap[K, V] {
+	if opts.Shards < 1 {
+		opts.Shards = 1
+	}
+	if opts.Hasher == nil {
+		opts.Hasher = DefaultHasher[K]()
+	}
+	if opts.VirtualNodes < 1 {
+		opts.VirtualNodes = 100
+	}
+
+	m := &ShardedMap[K, V]{opts: opts}
+	m.layout.Store(m.newLayout(opts.Shards))
 
-	for i := 0; i < nshards; i++ {
-		shard := make(map[K]V)
-		shards[i] = &Shard[K, V]{items: shard} // A ShardedMap IS a slice!
+	return m
+}
+
+// newLayout returns a layout of n empty shards.
+func (m *ShardedMap[K, V]) newLayout(n int) *shardLayout[K, V] {
+	l := &shardLayout[K, V]{shards: make([]*Shard[K, V], n), strategy: m.opts.Strategy}
+
+	for i := range l.shards {
+		l.shards[i] = &Shard[K, V]{items: make(map[K]V)}
 	}
 
-	return shards
+	if l.strategy == RingSharding {
+		l.ring = newHashRing(n, m.opts.VirtualNodes)
+	}
+
+	return l
+}
+
+// index returns the index of the shard for a key with hash h.
+func (l *shardLayout[K, V]) index(h uint64) int {
+	switch l.strategy {
+	case JumpSharding:
+		return jumpHash(mix64(h), len(l.shards))
+	case RingSharding:
+		return l.ring.shard(mix64(h))
+	default:
+		return int(h % uint64(len(l.shards)))
+	}
 }
 
 // getShardIndex accepts a key and returns a value in 0..N-1, where N is
 // the number of shards.
-func (m ShardedMap[K, V]) getShardIndex(key K) int {
-	str := reflect.ValueOf(key).String() // Get string representation of key
-	hash := fnv.New32a()                 // Get a hash implementation from "hash/fnv"
-	hash.Write([]byte(str))              // Write bytes to the hash
-	sum := int(hash.Sum32())             // Get the resulting checksum
-	return sum % len(m)                  // Mod by len(m) to get index
+func (m *ShardedMap[K, V]) getShardIndex(key K) int {
+	return m.layout.Load().index(m.opts.Hasher(key))
 }
 
-// getShard accepts a key and returns a pointer to its corresponding Shard.
-func (m ShardedMap[K, V]) getShard(key K) *Shard[K, V] {
-	index := m.getShardIndex(key)
-	return m[index]
+// lockShard returns key's shard, locked for writing. If a Reshard retires
+// the shard while lockShard waits for it, it tries again with the new one.
+func (m *ShardedMap[K, V]) lockShard(key K) *Shard[K, V] {
+	h := m.opts.Hasher(key)
+
+	for {
+		l := m.layout.Load()
+		shard := l.shards[l.index(h)]
+
+		shard.Lock()
+		if !shard.retired {
+			return shard
+		}
+		shard.Unlock()
+	}
+}
+
+// rlockShard is like lockShard, but locks the shard for reading.
+func (m *ShardedMap[K, V]) rlockShard(key K) *Shard[K, V] {
+	h := m.opts.Hasher(key)
+
+	for {
+		l := m.layout.Load()
+		shard := l.shards[l.index(h)]
+
+		shard.RLock()
+		if !shard.retired {
+			return shard
+		}
+		shard.RUnlock()
+	}
+}
+
+// Shards returns the current number of shards.
+func (m *ShardedMap[K, V]) Shards() int {
+	return len(m.layout.Load().shards)
+}
+
+// Reshard changes the number of shards to nshards, moving keys to their
+// new shards. Other operations can continue while it runs, except that
+// those on keys being moved wait until the move is complete. With
+// JumpSharding or RingSharding, only a fraction of the keys move.
+func (m *ShardedMap[K, V]) Reshard(nshards int) {
+	if nshards < 1 {
+		nshards = 1
+	}
+
+	m.resize.Lock()
+	defer m.resize.Unlock()
+
+	old := m.layout.Load()
+	if nshards == len(old.shards) {
+		return
+	}
+
+	next := m.newLayout(nshards)
+
+	for _, shard := range old.shards {
+		shard.Lock()
+		defer shard.Unlock()
+	}
+
+	// Surviving shards keep their maps, so only the keys that move are
+	// copied.
+	for i := range min(len(old.shards), nshards) {
+		next.shards[i].items = old.shards[i].items
+	}
+
+	for i, shard := range old.shards {
+		for key, value := range shard.items {
+			if j := next.index(m.opts.Hasher(key)); j != i {
+				next.shards[j].items[key] = value
+				if i < nshards {
+					delete(shard.items, key)
+				}
+			}
+		}
+
+		shard.retired = true
+	}
+
+	m.layout.Store(next)
 }
 
 // Delete removes a value from the map. If key doesn't exist in the map,
 // this method is a no-op.
-func (m ShardedMap[K, V]) Delete(key K) {
-	shard := m.getShard(key)
-	shard.Lock()
+func (m *ShardedMap[K, V]) Delete(key K) {
+	shard := m.lockShard(key)
 	defer shard.Unlock()
 
 	delete(shard.items, key)
 }
 
-// Get retrieves and returns a value from the map. If the value doesn't exist,
-// nil is returned.
-func (m ShardedMap[K, V]) Get(key K) V {
-	shard := m.getShard(key)
-	shard.RLock()
+// Get retrieves and returns a value from the map. If the value doesn't
+// exist, the zero value is returned; use Load to tell the difference.
+func (m *ShardedMap[K, V]) Get(key K) V {
+	v, _ := m.Load(key)
+	return v
+}
+
+// Load returns the value stored for key, and whether there was one.
+func (m *ShardedMap[K, V]) Load(key K) (value V, ok bool) {
+	shard := m.rlockShard(key)
 	defer shard.RUnlock()
 
-	return shard.items[key]
+	value, ok = shard.items[key]
+	return value, ok
 }
 
-func (m ShardedMap[K, V]) Set(key K, value V) {
-	shard := m.getShard(key)
-	shard.Lock()
+func (m *ShardedMap[K, V]) Set(key K, value V) {
+	shard := m.lockShard(key)
 	defer shard.Unlock()
 
 	shard.items[key] = value
 }
 
+// LoadOrStore returns the value stored for key if there is one, and
+// otherwise stores and returns value. loaded reports which.
+func (m *ShardedMap[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	shard := m.lockShard(key)
+	defer shard.Unlock()
+
+	if actual, loaded = shard.items[key]; loaded {
+		return actual, true
+	}
+
+	shard.items[key] = value
+	return value, false
+}
+
+// CompareAndSwap stores new for key if the value stored for key is equal
+// to old, and reports whether it did. Like sync.Map's, it panics if V
+// isn't comparable.
+func (m *ShardedMap[K, V]) CompareAndSwap(key K, old, new V) bool {
+	shard := m.lockShard(key)
+	defer shard.Unlock()
+
+	if v, ok := shard.items[key]; !ok || any(v) != any(old) {
+		return false
+	}
+
+	shard.items[key] = new
+	return true
+}
+
+// Compute calls f with the value stored for key, and whether there was
+// one, and stores the value f returns if keep is true or deletes key if
+// it's false. It returns the new value and whether it was kept. f runs
+// under the shard's lock, so it must be quick and mustn't use the map.
+func (m *ShardedMap[K, V]) Compute(key K, f func(value V, ok bool) (newValue V, keep bool)) (V, bool) {
+	shard := m.lockShard(key)
+	defer shard.Unlock()
+
+	value, ok := shard.items[key]
+
+	value, keep := f(value, ok)
+	if keep {
+		shard.items[key] = value
+	} else {
+		delete(shard.items, key)
+	}
+
+	return value, keep
+}
+
+// Update is like Compute, but only calls f if there's a value stored for
+// key, and always stores the result. It reports whether it did.
+func (m *ShardedMap[K, V]) Update(key K, f func(value V) V) (V, bool) {
+	shard := m.lockShard(key)
+	defer shard.Unlock()
+
+	value, ok := shard.items[key]
+	if !ok {
+		return value, false
+	}
+
+	value = f(value)
+	shard.items[key] = value
+
+	return value, true
+}
+
+// Len returns the number of keys in the map. Each shard is counted under
+// its own lock, so if the map is changed meanwhile the result may not
+// match any one moment.
+func (m *ShardedMap[K, V]) Len() int {
+	m.resize.RLock()
+	defer m.resize.RUnlock()
+
+	n := 0
+
+	for _, shard := range m.layout.Load().shards {
+		shard.RLock()
+		n += len(shard.items)
+		shard.RUnlock()
+	}
+
+	return n
+}
+
 // Keys returns a list of all keys in the sharded map.
-func (m ShardedMap[K, V]) Keys() []K {
-	var keys []K         // Declare an empty keys slice
-	var mutex sync.Mutex // Mutex for write safety to keys
+func (m *ShardedMap[K, V]) Keys() []K {
+	m.resize.RLock()
+	defer m.resize.RUnlock()
+
+	var keys []K
+
+	for _, shard := range m.layout.Load().shards {
+		shard.RLock()
+		keys = slices.AppendSeq(keys, maps.Keys(shard.items))
+		shard.RUnlock()
+	}
+
+	return keys
+}
 
-	var wg sync.WaitGroup // Create a wait group and add a
-	wg.Add(len(m))        // wait value for each slice
+// All returns an iterator over the map's keys and values. Each shard is
+// copied under its lock and then yielded without it, so the loop body is
+// free to use the map. Like sync.Map's Range, All doesn't correspond to a
+// consistent snapshot: changes made during iteration may or may not be
+// seen, and if the map is resharded meanwhile some keys may be seen twice
+// or not at all. Use Snapshot for a consistent view.
+func (m *ShardedMap[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		type entry struct {
+			key   K
+			value V
+		}
 
-	for _, shard := range m { // Run a goroutine for each slice in m
-		go func(s *Shard[K, V]) {
-			s.RLock() // Establish a read lock on s
+		var entries []entry
 
-			defer wg.Done()   // Release of the read lock
-			defer s.RUnlock() // Tell the WaitGroup it's done
+		for i := 0; ; i++ {
+			m.resize.RLock()
 
-			for key, _ := range s.items { // Get the slice's keys
-				mutex.Lock()
-				keys = append(keys, key)
-				mutex.Unlock()
+			shards := m.layout.Load().shards
+			if i >= len(shards) {
+				m.resize.RUnlock()
+				return
 			}
-		}(shard)
+
+			shard := shards[i]
+			shard.RLock()
+			entries = entries[:0]
+			for k, v := range shard.items {
+				entries = append(entries, entry{k, v})
+			}
+			shard.RUnlock()
+
+			m.resize.RUnlock()
+
+			for _, e := range entries {
+				if !yield(e.key, e.value) {
+					return
+				}
+			}
+		}
 	}
+}
+
+// Snapshot returns a copy of the map's contents at a single moment. Every
+// shard is locked for reading while it's copied.
+func (m *ShardedMap[K, V]) Snapshot() map[K]V {
+	m.resize.RLock()
+	defer m.resize.RUnlock()
 
-	wg.Wait() // Block until all goroutines are done
+	shards := m.layout.Load().shards
 
-	return keys // Return combined keys slice
+	for _, shard := range shards {
+		shard.RLock()
+		defer shard.RUnlock()
+	}
+
+	n := 0
+	for _, shard := range shards {
+		n += len(shard.items)
+	}
+
+	snapshot := make(map[K]V, n)
+	for _, shard := range shards {
+		maps.Copy(snapshot, shard.items)
+	}
+
+	return snapshot
+}
+
+// Clear removes every key from the map, all at once.
+func (m *ShardedMap[K, V]) Clear() {
+	m.resize.RLock()
+	defer m.resize.RUnlock()
+
+	shards := m.layout.Load().shards
+
+	for _, shard := range shards {
+		shard.Lock()
+		defer shard.Unlock()
+	}
+
+	for _, shard := range shards {
+		clear(shard.items)
+	}
 }
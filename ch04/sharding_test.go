@@ -17,6 +17,7 @@
 package ch04
 
 import (
+	"sync"
 	"testing"
 )
 
@@ -133,3 +134,312 @@ func TestShardingDelete(t *testing.T) {
 		t.Error("Deletion failure")
 	}
 }
+
+// TestShardingNonStringKeys tests that non-string keys are spread across
+// shards, rather than all hashing the same.
+func TestShardingNonStringKeys(t *testing.T) {
+	const BUCKETS = 8
+
+	sMap := NewShardedMap[int, int](BUCKETS)
+	counts := make([]int, BUCKETS)
+
+	for key := 0; key < 1000; key++ {
+		counts[sMap.getShardIndex(key)]++
+	}
+
+	for idx, count := range counts {
+		if count < 50 {
+			t.Errorf("shard %d has only %d of 1000 keys: %v", idx, count, counts)
+		}
+	}
+}
+
+// TestShardingHasher tests that a custom Hasher is used.
+func TestShardingHasher(t *testing.T) {
+	type point struct{ x, y int }
+
+	sMap := NewShardedMapWithOptions[point, string](ShardedMapOptions[point]{
+		Shards: 4,
+		Hasher: func(p point) uint64 { return uint64(p.x) },
+	})
+
+	for x := 0; x < 4; x++ {
+		if idx := sMap.getShardIndex(point{x, 42}); idx != x {
+			t.Errorf("expected point with x=%d in shard %d; got %d", x, x, idx)
+		}
+	}
+
+	sMap.Set(point{1, 2}, "a")
+	if v := sMap.Get(point{1, 2}); v != "a" {
+		t.Error("expected a; got", v)
+	}
+}
+
+// TestShardingReshard tests that resharding keeps every value, and that
+// the consistent strategies move only a fraction of the keys.
+func TestShardingReshard(t *testing.T) {
+	const KEYS = 10000
+
+	tests := []struct {
+		strategy ShardingStrategy
+		maxMoved float64 // Fraction of keys that may move going from 8 to 9 shards
+	}{
+		{ModuloSharding, 1},
+		{JumpSharding, 0.15},
+		{RingSharding, 0.2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy.String(), func(t *testing.T) {
+			sMap := NewShardedMapWithOptions[int, int](ShardedMapOptions[int]{Shards: 8, Strategy: tt.strategy})
+
+			before := make([]int, KEYS)
+			for key := 0; key < KEYS; key++ {
+				sMap.Set(key, key*2)
+				before[key] = sMap.getShardIndex(key)
+			}
+
+			sMap.Reshard(9)
+
+			if n := sMap.Shards(); n != 9 {
+				t.Fatal("expected 9 shards; got", n)
+			}
+
+			moved := 0
+			for key := 0; key < KEYS; key++ {
+				if sMap.getShardIndex(key) != before[key] {
+					moved++
+				}
+				if v := sMap.Get(key); v != key*2 {
+					t.Fatalf("key %d: expected %d; got %d", key, key*2, v)
+				}
+			}
+
+			if frac := float64(moved) / KEYS; frac > tt.maxMoved {
+				t.Errorf("expected at most %.2f of keys to move; %.2f did", tt.maxMoved, frac)
+			}
+
+			sMap.Reshard(3)
+
+			if n := len(sMap.Keys()); n != KEYS {
+				t.Errorf("expected %d keys after shrinking; got %d", KEYS, n)
+			}
+		})
+	}
+}
+
+// TestShardingReshardConcurrent tests that the map can be used while it's
+// being resharded.
+func TestShardingReshardConcurrent(t *testing.T) {
+	sMap := NewShardedMapWithOptions[int, int](ShardedMapOptions[int]{Shards: 2, Strategy: JumpSharding})
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < 1000; i++ {
+				key := w*1000 + i
+				sMap.Set(key, key)
+				if v := sMap.Get(key); v != key {
+					t.Errorf("key %d: expected %d; got %d", key, key, v)
+					return
+				}
+			}
+		}(w)
+	}
+
+	for n := 3; n <= 16; n++ {
+		sMap.Reshard(n)
+	}
+
+	wg.Wait()
+
+	if n := len(sMap.Keys()); n != 4000 {
+		t.Error("expected 4000 keys; got", n)
+	}
+}
+
+// TestShardingLoad tests that Load tells absent keys apart from zero
+// values.
+func TestShardingLoad(t *testing.T) {
+	sMap := NewShardedMap[string, int](17)
+	sMap.Set("zero", 0)
+
+	if v, ok := sMap.Load("zero"); !ok || v != 0 {
+		t.Errorf("expected 0, true; got %d, %v", v, ok)
+	}
+
+	if v, ok := sMap.Load("missing"); ok || v != 0 {
+		t.Errorf("expected 0, false; got %d, %v", v, ok)
+	}
+}
+
+// TestShardingLoadOrStore tests that LoadOrStore only stores absent keys.
+func TestShardingLoadOrStore(t *testing.T) {
+	sMap := NewShardedMap[string, int](17)
+
+	if v, loaded := sMap.LoadOrStore("alpha", 1); loaded || v != 1 {
+		t.Errorf("expected 1, false; got %d, %v", v, loaded)
+	}
+
+	if v, loaded := sMap.LoadOrStore("alpha", 2); !loaded || v != 1 {
+		t.Errorf("expected 1, true; got %d, %v", v, loaded)
+	}
+}
+
+// TestShardingCompareAndSwap tests that CompareAndSwap only swaps when
+// the stored value matches.
+func TestShardingCompareAndSwap(t *testing.T) {
+	sMap := NewShardedMap[string, int](17)
+
+	if sMap.CompareAndSwap("alpha", 0, 1) {
+		t.Error("expected no swap for a missing key")
+	}
+
+	sMap.Set("alpha", 1)
+
+	if sMap.CompareAndSwap("alpha", 2, 3) {
+		t.Error("expected no swap for a mismatched value")
+	}
+
+	if !sMap.CompareAndSwap("alpha", 1, 3) || sMap.Get("alpha") != 3 {
+		t.Error("expected swap to 3; got", sMap.Get("alpha"))
+	}
+}
+
+// TestShardingCompute tests Compute and Update, including that they're
+// atomic under concurrent use.
+func TestShardingCompute(t *testing.T) {
+	sMap := NewShardedMap[string, int](17)
+
+	if _, ok := sMap.Update("counter", func(v int) int { return v + 1 }); ok {
+		t.Error("expected Update of a missing key to do nothing")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sMap.Compute("counter", func(v int, ok bool) (int, bool) {
+				return v + 1, true
+			})
+		}()
+	}
+	wg.Wait()
+
+	if v, ok := sMap.Update("counter", func(v int) int { return v * 2 }); !ok || v != 200 {
+		t.Errorf("expected 200, true; got %d, %v", v, ok)
+	}
+
+	sMap.Compute("counter", func(v int, ok bool) (int, bool) { return 0, false })
+
+	if _, ok := sMap.Load("counter"); ok {
+		t.Error("expected Compute to delete the key")
+	}
+}
+
+// TestShardingAll tests Len, All, Snapshot and Clear.
+func TestShardingAll(t *testing.T) {
+	sMap := NewShardedMap[int, int](17)
+
+	for i := 0; i < 100; i++ {
+		sMap.Set(i, i*i)
+	}
+
+	if n := sMap.Len(); n != 100 {
+		t.Error("expected 100 keys; got", n)
+	}
+
+	seen := 0
+	for k, v := range sMap.All() {
+		if v != k*k {
+			t.Errorf("key %d: expected %d; got %d", k, k*k, v)
+		}
+		sMap.Delete(k) // The loop body can use the map
+		seen++
+	}
+
+	if seen != 100 || sMap.Len() != 0 {
+		t.Errorf("expected to see and delete 100 keys; saw %d, %d left", seen, sMap.Len())
+	}
+
+	sMap.Set(1, 1)
+	snapshot := sMap.Snapshot()
+	sMap.Set(2, 2)
+
+	if len(snapshot) != 1 || snapshot[1] != 1 {
+		t.Error("expected snapshot of {1: 1}; got", snapshot)
+	}
+
+	sMap.Clear()
+
+	if n := sMap.Len(); n != 0 {
+		t.Error("expected Clear to remove every key;", n, "left")
+	}
+}
+
+// The benchmarks below compare ShardedMap to sync.Map under parallel load
+// with a read-heavy mix (90% reads) and a write-heavy mix (50% writes).
+
+const benchKeys = 1 << 12
+
+func benchmarkMap(b *testing.B, writePercent int, load func(int) (int, bool), store func(int, int)) {
+	for i := 0; i < benchKeys; i++ {
+		store(i, i)
+	}
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := (i * 2654435761) % benchKeys
+			if i%100 < writePercent {
+				store(key, i)
+			} else {
+				load(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkShardedMapReadHeavy(b *testing.B) {
+	sMap := NewShardedMap[int, int](32)
+	benchmarkMap(b, 10, sMap.Load, sMap.Set)
+}
+
+func BenchmarkSyncMapReadHeavy(b *testing.B) {
+	var sm sync.Map
+	benchmarkMap(b, 10, syncMapLoad(&sm), syncMapStore(&sm))
+}
+
+func BenchmarkShardedMapWriteHeavy(b *testing.B) {
+	sMap := NewShardedMap[int, int](32)
+	benchmarkMap(b, 50, sMap.Load, sMap.Set)
+}
+
+func BenchmarkSyncMapWriteHeavy(b *testing.B) {
+	var sm sync.Map
+	benchmarkMap(b, 50, syncMapLoad(&sm), syncMapStore(&sm))
+}
+
+func syncMapLoad(sm *sync.Map) func(int) (int, bool) {
+	return func(key int) (int, bool) {
+		v, ok := sm.Load(key)
+		if !ok {
+			return 0, false
+		}
+		return v.(int), true
+	}
+}
+
+func syncMapStore(sm *sync.Map) func(int, int) {
+	return func(key, value int) {
+		sm.Store(key, value)
+	}
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SlidingWindowLog is a Limiter that grants at most limit permits in any
+// window-long period. It keeps the time of every permit granted in the
+// last window, so it's exact, at the cost of memory proportional to limit.
+//
+// A SlidingWindowLog is safe for concurrent use.
+type SlidingWindowLog struct {
+	limit  int
+	window time.Duration
+	clock  Clock
+
+	m   sync.Mutex
+	log []time.Time // Times of granted permits, in order
+}
+
+// NewSlidingWindowLog returns a SlidingWindowLog that grants at most
+// limit permits per window.
+func NewSlidingWindowLog(limit int, window time.Duration) *SlidingWindowLog {
+	return NewSlidingWindowLogWithClock(limit, window, systemClock{})
+}
+
+// NewSlidingWindowLogWithClock returns a SlidingWindowLog that reads the
+// time from clock.
+func NewSlidingWindowLogWithClock(limit int, window time.Duration, clock Clock) *SlidingWindowLog {
+	return &SlidingWindowLog{limit: limit, window: window, clock: clock}
+}
+
+// expire drops permits that have left the window. Must be called with
+// l.m held.
+func (l *SlidingWindowLog) expire(now time.Time) {
+	cutoff := now.Add(-l.window)
+
+	i := 0
+	for i < len(l.log) && !l.log[i].After(cutoff) {
+		i++
+	}
+
+	l.log = l.log[i:]
+}
+
+// Allow takes a permit if fewer than limit have been granted in the last
+// window.
+func (l *SlidingWindowLog) Allow() bool {
+	now := l.clock.Now()
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.expire(now)
+
+	if len(l.log) >= l.limit {
+		return false
+	}
+
+	l.log = append(l.log, now)
+
+	return true
+}
+
+// Reserve takes a permit for the earliest time at which fewer than limit
+// permits will have been granted in the preceding window.
+func (l *SlidingWindowLog) Reserve() *Reservation {
+	now := l.clock.Now()
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.expire(now)
+
+	r := &Reservation{clock: l.clock, at: now, cancel: l.unreserve}
+
+	if l.limit <= 0 {
+		return r // Not OK: no permit will ever be granted
+	}
+
+	if len(l.log) >= l.limit {
+		r.at = l.log[len(l.log)-l.limit].Add(l.window)
+	}
+
+	l.log = append(l.log, r.at)
+	r.ok = true
+
+	return r
+}
+
+// unreserve removes the permit reserved for at from the log.
+func (l *SlidingWindowLog) unreserve(at time.Time) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	for i := len(l.log) - 1; i >= 0; i-- {
+		if l.log[i].Equal(at) {
+			l.log = append(l.log[:i], l.log[i+1:]...)
+			return
+		}
+	}
+}
+
+// Wait takes a permit, waiting until one is available.
+func (l *SlidingWindowLog) Wait(ctx context.Context) error {
+	return waitReservation(ctx, l.Reserve(), nil)
+}
+
+// SlidingWindowCounter is a Limiter that approximates a sliding window
+// with two fixed windows. It estimates the number of permits granted in
+// the last window as the count for the current fixed window, plus the
+// count for the previous one weighted by how much of it the sliding
+// window still overlaps. It uses constant memory regardless of limit.
+//
+// A SlidingWindowCounter is safe for concurrent use.
+type SlidingWindowCounter struct {
+	limit  int
+	window time.Duration
+	clock  Clock
+
+	m      sync.Mutex
+	counts map[int64]int // Permits granted, by fixed window index
+}
+
+// NewSlidingWindowCounter returns a SlidingWindowCounter that grants
+// approximately at most limit permits per window. A window of less than a
+// nanosecond is taken to be a nanosecond.
+func NewSlidingWindowCounter(limit int, window time.Duration) *SlidingWindowCounter {
+	return NewSlidingWindowCounterWithClock(limit, window, systemClock{})
+}
+
+// NewSlidingWindowCounterWithClock returns a SlidingWindowCounter that
+// reads the time from clock.
+func NewSlidingWindowCounterWithClock(limit int, window time.Duration, clock Clock) *SlidingWindowCounter {
+	if window < time.Nanosecond {
+		window = time.Nanosecond
+	}
+
+	return &SlidingWindowCounter{
+		limit:  limit,
+		window: window,
+		clock:  clock,
+		counts: make(map[int64]int),
+	}
+}
+
+// index returns the index of the fixed window containing t, and how far
+// through that window t is, from 0 to 1.
+func (c *SlidingWindowCounter) index(t time.Time) (int64, float64) {
+	ns := t.UnixNano()
+	w := int64(c.window)
+	return ns / w, float64(ns%w) / float64(w)
+}
+
+// earliest returns the earliest time at or after now at which a permit
+// may be granted. Must be called with c.m held.
+func (c *SlidingWindowCounter) earliest(now time.Time) time.Time {
+	k, f := c.index(now)
+
+	for ; ; k, f = k+1, 0 {
+		prev, curr := float64(c.counts[k-1]), float64(c.counts[k])
+		room := float64(c.limit) - curr - 1
+
+		if room < 0 {
+			continue // This fixed window is already full
+		}
+
+		// The estimate is prev*(1-f) + curr, so a permit fits once
+		// prev*(1-f) <= room.
+		if prev > room {
+			f = max(f, 1-room/prev)
+		}
+
+		if f >= 1 {
+			continue // Not before the end of this fixed window
+		}
+
+		start := time.Unix(0, k*int64(c.window))
+		return start.Add(time.Duration(f * float64(c.window)))
+	}
+}
+
+// expire drops counts for fixed windows that no longer affect the
+// estimate. Must be called with c.m held.
+func (c *SlidingWindowCounter) expire(now time.Time) {
+	k, _ := c.index(now)
+
+	for i := range c.counts {
+		if i < k-1 {
+			delete(c.counts, i)
+		}
+	}
+}
+
+// Allow takes a permit if the estimated number granted in the last window
+// is less than limit.
+func (c *SlidingWindowCounter) Allow() bool {
+	now := c.clock.Now()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.expire(now)
+
+	if c.limit <= 0 || c.earliest(now).After(now) {
+		return false
+	}
+
+	k, _ := c.index(now)
+	c.counts[k]++
+
+	return true
+}
+
+// Reserve takes a permit for the earliest time at which the estimate will
+// allow it.
+func (c *SlidingWindowCounter) Reserve() *Reservation {
+	now := c.clock.Now()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.expire(now)
+
+	r := &Reservation{clock: c.clock, at: now, cancel: c.unreserve}
+
+	if c.limit <= 0 {
+		return r // Not OK: no permit will ever be granted
+	}
+
+	r.at = c.earliest(now)
+	k, _ := c.index(r.at)
+	c.counts[k]++
+	r.ok = true
+
+	return r
+}
+
+// unreserve removes the permit reserved for at from its window's count.
+func (c *SlidingWindowCounter) unreserve(at time.Time) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	k, _ := c.index(at)
+	if c.counts[k] > 0 {
+		c.counts[k]--
+	}
+}
+
+// Wait takes a permit, waiting until one is available.
+func (c *SlidingWindowCounter) Wait(ctx context.Context) error {
+	return waitReservation(ctx, c.Reserve(), nil)
+}
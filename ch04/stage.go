@@ -0,0 +1,103 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"sync"
+)
+
+// Pipeline is a pipeline stage: it calls f with each value from source,
+// using up to workers goroutines (at least one) at once, and sends the
+// results to the returned channel in the order they're ready. Stages are
+// chained by passing one's output as the next one's source.
+//
+// The first error returned by f stops the stage, and is sent on the
+// returned error channel; if ctx is done first, ctx.Err() is sent instead.
+// Both channels are closed once the stage has stopped. A failed stage
+// keeps receiving and discarding values from source, so upstream stages
+// aren't left blocked; cancel ctx to stop them too.
+func Pipeline[In, Out any](ctx context.Context, source <-chan In, workers int, f func(context.Context, In) (Out, error)) (<-chan Out, <-chan error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	dest := make(chan Out)
+	errs := make(chan error, 1)
+
+	sctx, cancel := context.WithCancel(ctx)
+
+	var once sync.Once
+	failed := false
+
+	fail := func(err error) {
+		once.Do(func() {
+			failed = true
+			errs <- err
+			cancel()
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+
+	for range workers {
+		go func() {
+			defer wg.Done()
+
+			for {
+				v, ok := receive(sctx, source)
+				if !ok {
+					return
+				}
+
+				res, err := f(sctx, v)
+				if err != nil {
+					fail(err)
+					return
+				}
+
+				if !send(sctx, dest, res) {
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer cancel()
+
+		wg.Wait()
+
+		if !failed && ctx.Err() != nil {
+			errs <- ctx.Err()
+		}
+
+		close(dest)
+		close(errs)
+
+		if failed {
+			for {
+				if _, ok := receive(ctx, source); !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	return dest, errs
+}
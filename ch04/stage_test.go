@@ -0,0 +1,119 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestPipeline tests chained stages, and that a stage never runs more
+// than its number of workers at once.
+func TestPipeline(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	ctx := context.Background()
+	var running, peak atomic.Int32
+
+	squares, errs1 := Pipeline(ctx, generate(1, 2, 3, 4, 5, 6), 3, func(ctx context.Context, n int) (int, error) {
+		r := running.Add(1)
+		defer running.Add(-1)
+
+		for p := peak.Load(); r > p && !peak.CompareAndSwap(p, r); p = peak.Load() {
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		return n * n, nil
+	})
+
+	strs, errs2 := Pipeline(ctx, squares, 1, func(ctx context.Context, n int) (string, error) {
+		return strconv.Itoa(n), nil
+	})
+
+	var got []string
+	for s := range strs {
+		got = append(got, s)
+	}
+
+	for err := range FanIn(ctx, errs1, errs2) {
+		t.Error("unexpected error:", err)
+	}
+
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"1", "16", "25", "36", "4", "9"}) {
+		t.Error("unexpected results:", got)
+	}
+
+	if p := peak.Load(); p > 3 {
+		t.Error("expected at most 3 workers at once; got", p)
+	}
+}
+
+// TestPipelineError tests that an error stops the stage and is reported,
+// and that the upstream stage isn't left blocked.
+func TestPipelineError(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	ctx := context.Background()
+	cause := errors.New("INTENTIONAL FAIL!")
+
+	values := make([]int, 100)
+	upstream, upErrs := Pipeline(ctx, generate(values...), 2, func(ctx context.Context, n int) (int, error) {
+		return n, nil
+	})
+
+	out, errs := Pipeline(ctx, upstream, 2, func(ctx context.Context, n int) (int, error) {
+		return 0, cause
+	})
+
+	for range out {
+	}
+
+	if err := <-errs; !errors.Is(err, cause) {
+		t.Error("expected", cause, "; got", err)
+	}
+
+	if err, ok := <-upErrs; ok {
+		t.Error("expected upstream to finish without error; got", err)
+	}
+}
+
+// TestPipelineCancel tests that a stage reports ctx.Err() if its context
+// is done, and doesn't leak goroutines.
+func TestPipelineCancel(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	out, errs := Pipeline(ctx, make(chan int), 4, func(ctx context.Context, n int) (int, error) {
+		return n, nil
+	})
+
+	cancel()
+
+	for range out {
+	}
+
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Error("expected context canceled; got", err)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"reflect"
+)
+
+// Tee returns n channels (at least one), and sends each value from source
+// to all of them. It only receives the next value once every destination
+// has received the last, so it proceeds at the pace of the slowest, but
+// destinations can receive each value in any order. Every destination is
+// closed once source is closed, or once ctx is done.
+func Tee[T any](ctx context.Context, source <-chan T, n int) []<-chan T {
+	n = max(n, 1)
+	dests := make([]chan T, n)
+	result := make([]<-chan T, n)
+
+	for i := range dests {
+		dests[i] = make(chan T)
+		result[i] = dests[i]
+	}
+
+	go func() {
+		defer func() {
+			for _, ch := range dests {
+				close(ch)
+			}
+		}()
+
+		// The last case is ctx.Done(). A destination's case is disabled
+		// once it's been sent the current value.
+		cases := make([]reflect.SelectCase, n+1)
+		cases[n] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}
+
+		for {
+			v, ok := receive(ctx, source)
+			if !ok {
+				return
+			}
+
+			rv := reflect.ValueOf(&v).Elem()
+			for i, ch := range dests {
+				cases[i] = reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(ch), Send: rv}
+			}
+
+			for range dests {
+				chosen, _, _ := reflect.Select(cases)
+				if chosen == n {
+					return
+				}
+				cases[chosen].Chan = reflect.Value{}
+			}
+		}
+	}()
+
+	return result
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+// TestTee tests that every destination receives every value, in whatever
+// order the destinations are read.
+func TestTee(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	dests := Tee(context.Background(), generate(1, 2, 3), 2)
+
+	// Read the second destination first, from a single goroutine.
+	var got [2][]int
+	for range 3 {
+		got[1] = append(got[1], <-dests[1])
+		got[0] = append(got[0], <-dests[0])
+	}
+
+	for i := range got {
+		if !slices.Equal(got[i], []int{1, 2, 3}) {
+			t.Errorf("destination %d: expected [1 2 3]; got %v", i, got[i])
+		}
+	}
+
+	for _, ch := range dests {
+		if _, ok := <-ch; ok {
+			t.Error("expected destination to be closed")
+		}
+	}
+}
+
+// TestTeeCancel tests that Tee closes its destinations, without leaking
+// goroutines, when its context is done while a destination isn't reading.
+func TestTeeCancel(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	source := make(chan int, 3)
+	source <- 1
+	source <- 2
+	source <- 3
+
+	dests := Tee(ctx, source, 2)
+
+	<-dests[0] // The second destination never reads
+	cancel()
+
+	collectAll(dests)
+}
+
+// TestTeeNoDestinations tests that Tee uses a single destination if asked
+// for fewer.
+func TestTeeNoDestinations(t *testing.T) {
+	defer checkGoroutines(t)()
+
+	got := collectAll(Tee(context.Background(), generate(1, 2, 3), -1))
+	if len(got) != 1 || !slices.Equal(got[0], []int{1, 2, 3}) {
+		t.Error("expected [[1 2 3]]; got", got)
+	}
+}
@@ -18,56 +18,196 @@ package ch04
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"sync"
 	"time"
 )
 
-type Effector func(context.Context) (string, error)
+// EffectorOf is a function that performs an operation, typically one with
+// side effects, and returns a result of type T.
+type EffectorOf[T any] func(context.Context) (T, error)
 
+// Effector is an EffectorOf that returns a string.
+type Effector = EffectorOf[string]
+
+// ErrTooManyCalls is returned by a throttled effector that has run out of
+// tokens.
+var ErrTooManyCalls = errors.New("too many calls")
+
+// Throttle returns an Effector that allows at most max calls to e, and
+// refills at a rate of refill calls every d. Use NewTokenBucket and
+// ThrottleWith to share a bucket or to wait for tokens.
 func Throttle(e Effector, max uint, refill uint, d time.Duration) Effector {
-	var tokens = max
-	var once sync.Once
-	var m sync.Mutex
+	return ThrottleOf(e, max, refill, d)
+}
+
+// ThrottleOf is the generic form of Throttle.
+func ThrottleOf[T any](e EffectorOf[T], max uint, refill uint, d time.Duration) EffectorOf[T] {
+	return ThrottleWithOf(NewTokenBucket(max, refill, d), e, false)
+}
+
+// ThrottleWith returns an Effector that takes a permit from limiter before
+// each call to e. If wait is false, a call that finds no permit available
+// fails immediately with ErrTooManyCalls. If wait is true, it waits for a
+// permit until its context is done.
+func ThrottleWith(limiter Limiter, e Effector, wait bool) Effector {
+	return ThrottleWithOf(limiter, e, wait)
+}
+
+// ThrottleWithOf is the generic form of ThrottleWith.
+func ThrottleWithOf[T any](limiter Limiter, e EffectorOf[T], wait bool) EffectorOf[T] {
+	return func(ctx context.Context) (T, error) {
+		var zero T
 
-	return func(ctx context.Context) (string, error) {
 		if ctx.Err() != nil {
-			return "", ctx.Err()
+			return zero, ctx.Err()
 		}
 
-		once.Do(func() {
-			ticker := time.NewTicker(d)
-
-			go func() {
-				defer ticker.Stop()
-
-				for {
-					select {
-					case <-ctx.Done():
-						return
-
-					case <-ticker.C:
-						m.Lock()
-						t := tokens + refill
-						if t > max {
-							t = max
-						}
-						tokens = t
-						m.Unlock()
-					}
-				}
-			}()
-		})
-
-		m.Lock()
-		defer m.Unlock()
-
-		if tokens <= 0 {
-			return "", fmt.Errorf("too many calls")
+		if wait {
+			if err := limiter.Wait(ctx); err != nil {
+				return zero, err
+			}
+		} else if !limiter.Allow() {
+			return zero, ErrTooManyCalls
 		}
 
-		tokens--
-
 		return e(ctx)
 	}
 }
+
+// TokenBucket holds up to max tokens, and is refilled by refill tokens
+// every d. Rather than running a goroutine to add tokens, it computes
+// refills lazily from the time elapsed since the last one, so an idle
+// bucket costs nothing. The refill period starts on first use.
+//
+// Reserving a token when the bucket is empty borrows against future
+// refills, so reservations are granted in order. A TokenBucket may be
+// shared by any number of throttled effectors, and is safe for concurrent
+// use.
+type TokenBucket struct {
+	max    uint
+	refill uint
+	d      time.Duration
+	clock  Clock
+
+	m       sync.Mutex
+	tokens  int64         // Negative when future refills are reserved
+	last    time.Time     // Time of the most recent refill
+	started bool          // Whether last has been set
+	stopped bool          // Whether Stop has been called
+	done    chan struct{} // Closed by Stop
+}
+
+// NewTokenBucket returns a full TokenBucket.
+func NewTokenBucket(max uint, refill uint, d time.Duration) *TokenBucket {
+	return NewTokenBucketWithClock(max, refill, d, systemClock{})
+}
+
+// NewTokenBucketWithClock returns a full TokenBucket that reads the time
+// from clock. Wait still uses real timers to sleep until the next refill.
+func NewTokenBucketWithClock(max uint, refill uint, d time.Duration, clock Clock) *TokenBucket {
+	return &TokenBucket{
+		max:    max,
+		refill: refill,
+		d:      d,
+		clock:  clock,
+		tokens: int64(max),
+		done:   make(chan struct{}),
+	}
+}
+
+// advance adds the refills due as of now. Must be called with b.m held.
+func (b *TokenBucket) advance(now time.Time) {
+	if !b.started {
+		b.last, b.started = now, true
+	}
+
+	if b.stopped || b.d <= 0 {
+		return
+	}
+
+	if refills := now.Sub(b.last) / b.d; refills > 0 {
+		added := int64(refills) * int64(b.refill)
+		if added < 0 || added > int64(b.max)-b.tokens { // Overflow or full
+			b.tokens = int64(b.max)
+		} else {
+			b.tokens += added
+		}
+		b.last = b.last.Add(refills * b.d)
+	}
+}
+
+// Allow takes a token if one is available, and reports whether it did.
+func (b *TokenBucket) Allow() bool {
+	now := b.clock.Now() // Read the clock outside of the lock
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.advance(now)
+
+	if b.tokens <= 0 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// Reserve takes a token, borrowing against a future refill if the bucket
+// is empty. The Reservation isn't OK if the bucket will never refill.
+func (b *TokenBucket) Reserve() *Reservation {
+	now := b.clock.Now()
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.advance(now)
+
+	r := &Reservation{clock: b.clock, at: now, cancel: b.unreserve}
+
+	if b.tokens <= 0 {
+		if b.stopped || b.d <= 0 || b.refill == 0 {
+			return r // Not OK: no refill is coming
+		}
+
+		deficit := 1 - b.tokens
+		refills := (deficit + int64(b.refill) - 1) / int64(b.refill)
+		r.at = b.last.Add(time.Duration(refills) * b.d)
+	}
+
+	b.tokens--
+	r.ok = true
+
+	return r
+}
+
+// unreserve returns a reserved token to the bucket.
+func (b *TokenBucket) unreserve(time.Time) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.tokens = min(b.tokens+1, int64(b.max))
+}
+
+// Wait takes a token, waiting for a refill if none is available. It
+// returns an error if the context is done, or its deadline would pass,
+// before the token is available, or ErrTooManyCalls if the bucket is
+// stopped while empty.
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	return waitReservation(ctx, b.Reserve(), b.done)
+}
+
+// Stop stops the bucket from refilling, and releases any callers waiting
+// for a token. Tokens already in the bucket may still be taken. Stop is
+// safe to call more than once.
+func (b *TokenBucket) Stop() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if !b.stopped {
+		b.stopped = true
+		close(b.done)
+	}
+}
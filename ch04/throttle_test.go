@@ -18,7 +18,10 @@ package ch04
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -174,3 +177,264 @@ func TestThrottleContextTimeout(t *testing.T) {
 		t.Error("didn't get expected error")
 	}
 }
+
+// TestThrottleRefillOutlivesContext tests that a Throttle keeps refilling
+// after the context of its first call is done.
+func TestThrottleRefillOutlivesContext(t *testing.T) {
+	callsCounter := 0
+	effector := callsCountFunction(&callsCounter)
+
+	throttle := Throttle(effector, 1, 1, 50*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := throttle(ctx); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	cancel()
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := throttle(context.Background()); err != nil {
+		t.Error("expected bucket to have been refilled; got", err)
+	}
+}
+
+// TestThrottleWithWait tests that a waiting throttle waits for tokens
+// rather than failing.
+func TestThrottleWithWait(t *testing.T) {
+	callsCounter := 0
+	effector := callsCountFunction(&callsCounter)
+
+	bucket := NewTokenBucket(1, 1, 50*time.Millisecond)
+	defer bucket.Stop()
+
+	throttle := ThrottleWith(bucket, effector, true)
+	start := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if _, err := throttle(context.Background()); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Error("expected calls to wait for refills; took", elapsed)
+	}
+
+	if callsCounter != 3 {
+		t.Error("expected 3; got", callsCounter)
+	}
+}
+
+// TestThrottleWithWaitDeadline tests that a waiting throttle gives up
+// when its context's deadline passes.
+func TestThrottleWithWaitDeadline(t *testing.T) {
+	callsCounter := 0
+	effector := callsCountFunction(&callsCounter)
+
+	bucket := NewTokenBucket(1, 1, time.Hour)
+	defer bucket.Stop()
+
+	throttle := ThrottleWith(bucket, effector, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	throttle(ctx)
+
+	if _, err := throttle(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected deadline exceeded; got", err)
+	}
+}
+
+// TestTokenBucketStop tests that Stop releases waiters and stops refills.
+func TestTokenBucketStop(t *testing.T) {
+	bucket := NewTokenBucket(1, 1, 20*time.Millisecond)
+	bucket.Allow()
+
+	errCh := make(chan error)
+	go func() {
+		bucket.Stop()
+		bucket.Stop()
+	}()
+	go func() {
+		errCh <- bucket.Wait(context.Background())
+	}()
+
+	// The waiter either got a refill that raced with Stop, or was
+	// released with ErrTooManyCalls.
+	if err := <-errCh; err != nil && !errors.Is(err, ErrTooManyCalls) {
+		t.Error("unexpected error:", err)
+	}
+
+	bucket.Allow()
+	time.Sleep(50 * time.Millisecond)
+
+	if bucket.Allow() {
+		t.Error("expected no refills after Stop")
+	}
+
+	if _, err := ThrottleWith(bucket, callsCountFunction(new(int)), false)(context.Background()); !errors.Is(err, ErrTooManyCalls) {
+		t.Error("expected ErrTooManyCalls; got", err)
+	}
+}
+
+// TestTokenBucketLazyRefill tests refills computed from elapsed time,
+// driven by a fake clock.
+func TestTokenBucketLazyRefill(t *testing.T) {
+	clock := newFakeClock()
+	bucket := NewTokenBucketWithClock(4, 2, time.Second, clock)
+
+	allowed := func() int {
+		n := 0
+		for bucket.Allow() {
+			n++
+		}
+		return n
+	}
+
+	if n := allowed(); n != 4 {
+		t.Error("expected a full bucket of 4; got", n)
+	}
+
+	clock.advance(999 * time.Millisecond)
+	if n := allowed(); n != 0 {
+		t.Error("expected no refill before 1s; got", n)
+	}
+
+	// The partial period carries over: at 1.5s one refill has happened,
+	// and the next is half a second away.
+	clock.advance(501 * time.Millisecond)
+	if n := allowed(); n != 2 {
+		t.Error("expected 2 tokens after one refill; got", n)
+	}
+
+	clock.advance(500 * time.Millisecond)
+	if n := allowed(); n != 2 {
+		t.Error("expected 2 tokens after the second refill; got", n)
+	}
+
+	clock.advance(time.Hour)
+	if n := allowed(); n != 4 {
+		t.Error("expected bucket to be capped at 4; got", n)
+	}
+}
+
+// tickerTokenBucket is the goroutine-per-bucket design that TokenBucket
+// replaced, kept here so that the two can be benchmarked against each
+// other.
+type tickerTokenBucket struct {
+	m      sync.Mutex
+	tokens uint
+	done   chan struct{}
+}
+
+func newTickerTokenBucket(max uint, refill uint, d time.Duration) *tickerTokenBucket {
+	b := &tickerTokenBucket{tokens: max, done: make(chan struct{})}
+	ticker := time.NewTicker(d)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-b.done:
+				return
+			case <-ticker.C:
+				b.m.Lock()
+				b.tokens = min(b.tokens+refill, max)
+				b.m.Unlock()
+			}
+		}
+	}()
+
+	return b
+}
+
+func (b *tickerTokenBucket) Allow() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.tokens == 0 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+func (b *tickerTokenBucket) Stop() {
+	close(b.done)
+}
+
+// BenchmarkTokenBucketAllow compares the cost of Allow on a single bucket
+// shared by many goroutines.
+func BenchmarkTokenBucketAllow(b *testing.B) {
+	b.Run("lazy", func(b *testing.B) {
+		bucket := NewTokenBucket(1000, 1000, time.Millisecond)
+		defer bucket.Stop()
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				bucket.Allow()
+			}
+		})
+	})
+
+	b.Run("ticker", func(b *testing.B) {
+		bucket := newTickerTokenBucket(1000, 1000, time.Millisecond)
+		defer bucket.Stop()
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				bucket.Allow()
+			}
+		})
+	})
+}
+
+// BenchmarkTokenBucketMany compares the cost of many buckets, each used
+// by one goroutine, as when thousands of effectors are throttled
+// separately. The ticker design pays for a goroutine and a timer per
+// bucket.
+func BenchmarkTokenBucketMany(b *testing.B) {
+	const buckets = 10000
+
+	b.Run("lazy", func(b *testing.B) {
+		bs := make([]*TokenBucket, buckets)
+		for i := range bs {
+			bs[i] = NewTokenBucket(10, 10, 10*time.Millisecond)
+		}
+
+		var next atomic.Int64
+		b.ResetTimer()
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				bs[next.Add(1)%buckets].Allow()
+			}
+		})
+	})
+
+	b.Run("ticker", func(b *testing.B) {
+		bs := make([]*tickerTokenBucket, buckets)
+		for i := range bs {
+			bs[i] = newTickerTokenBucket(10, 10, 10*time.Millisecond)
+		}
+		defer func() {
+			for _, bucket := range bs {
+				bucket.Stop()
+			}
+		}()
+
+		var next atomic.Int64
+		b.ResetTimer()
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				bs[next.Add(1)%buckets].Allow()
+			}
+		})
+	})
+}
@@ -16,32 +16,176 @@
 
 package ch04
 
-import "context"
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
 
-type TimeoutFunction func(string) (string, error)
+// TimeoutFunctionOf is a context-unaware function that accepts an A and
+// returns a T.
+type TimeoutFunctionOf[A, T any] func(A) (T, error)
 
-type WithContext func(context.Context, string) (string, error)
+// WithContextOf is a TimeoutFunctionOf that also accepts a context.
+type WithContextOf[A, T any] func(context.Context, A) (T, error)
 
+// TimeoutFunction is a TimeoutFunctionOf that accepts and returns strings.
+type TimeoutFunction = TimeoutFunctionOf[string, string]
+
+// WithContext is a WithContextOf that accepts and returns strings.
+type WithContext = WithContextOf[string, string]
+
+// ErrTooManyAbandoned is returned by a timeout wrapper that refuses to
+// start a call because its TimeoutGuard's cap on abandoned calls has been
+// reached.
+var ErrTooManyAbandoned = errors.New("too many abandoned calls")
+
+// Timeout returns a function that calls f in a goroutine, and returns when
+// either f does or the context is done. In the latter case f keeps
+// running, abandoned; use TimeoutWith to track and cap abandoned calls.
 func Timeout(f TimeoutFunction) WithContext {
-	return func(ctx context.Context, arg string) (string, error) {
-		ch := make(chan struct {
-			result string
+	return TimeoutOf(f)
+}
+
+// TimeoutOf is the generic form of Timeout.
+func TimeoutOf[A, T any](f TimeoutFunctionOf[A, T]) WithContextOf[A, T] {
+	return TimeoutWithOf(NewTimeoutGuard(TimeoutOptions{}), f)
+}
+
+// TimeoutOptions configures a TimeoutGuard.
+type TimeoutOptions struct {
+	// MaxAbandoned caps the number of abandoned calls: calls that are
+	// still running after their callers stopped waiting. While the cap is
+	// reached, new calls fail immediately with ErrTooManyAbandoned. Calls
+	// already in flight when the cap is reached may still be abandoned,
+	// so the count can briefly exceed it. Zero means no cap.
+	MaxAbandoned int
+
+	// OnAbandon, if set, is called when a caller stops waiting for a call,
+	// with the number of calls now abandoned.
+	OnAbandon func(abandoned int)
+
+	// OnAbandonedReturn, if set, is called when an abandoned call finally
+	// returns, with the number of calls still abandoned and the error the
+	// call returned.
+	OnAbandonedReturn func(abandoned int, err error)
+}
+
+// TimeoutGuard tracks the calls abandoned by the timeout wrappers that
+// share it, and caps how many may be outstanding. Share one TimeoutGuard
+// between wrappers around the same dependency to cap them together.
+type TimeoutGuard struct {
+	opts      TimeoutOptions
+	abandoned atomic.Int64
+}
+
+// NewTimeoutGuard returns a TimeoutGuard configured by opts.
+func NewTimeoutGuard(opts TimeoutOptions) *TimeoutGuard {
+	return &TimeoutGuard{opts: opts}
+}
+
+// Abandoned returns the number of calls currently abandoned.
+func (g *TimeoutGuard) Abandoned() int {
+	return int(g.abandoned.Load())
+}
+
+// TimeoutWith is like Timeout, but tracks the calls it abandons with g,
+// and refuses to start calls while g's cap is reached.
+func TimeoutWith(g *TimeoutGuard, f TimeoutFunction) WithContext {
+	return TimeoutWithOf(g, f)
+}
+
+// TimeoutWithOf is the generic form of TimeoutWith.
+func TimeoutWithOf[A, T any](g *TimeoutGuard, f TimeoutFunctionOf[A, T]) WithContextOf[A, T] {
+	return func(ctx context.Context, arg A) (T, error) {
+		return runGuarded(ctx, g, func() (T, error) {
+			return f(arg)
+		})
+	}
+}
+
+// TimeoutContextWith is like TimeoutWith, but for a function that accepts
+// a context. The function is passed a context that's canceled as soon as
+// the caller stops waiting, so that it can stop work that's no longer
+// wanted. It's still tracked as abandoned until it returns.
+func TimeoutContextWith(g *TimeoutGuard, f WithContext) WithContext {
+	return TimeoutContextWithOf(g, f)
+}
+
+// TimeoutContextWithOf is the generic form of TimeoutContextWith.
+func TimeoutContextWithOf[A, T any](g *TimeoutGuard, f WithContextOf[A, T]) WithContextOf[A, T] {
+	return func(ctx context.Context, arg A) (T, error) {
+		cctx, cancel := context.WithCancel(ctx)
+		defer cancel() // Propagate cancellation when we stop waiting
+
+		return runGuarded(ctx, g, func() (T, error) {
+			return f(cctx, arg)
+		})
+	}
+}
+
+// States of a call started by runGuarded.
+const (
+	callRunning int32 = iota
+	callReturned
+	callAbandoned
+)
+
+// runGuarded calls fn in a goroutine, and returns when either fn does or
+// ctx is done. In the latter case it records fn's call as abandoned with
+// g until fn returns.
+func runGuarded[T any](ctx context.Context, g *TimeoutGuard, fn func() (T, error)) (T, error) {
+	var zero T
+
+	if ctx.Err() != nil {
+		return zero, ctx.Err()
+	}
+
+	if g.opts.MaxAbandoned > 0 && g.Abandoned() >= g.opts.MaxAbandoned {
+		return zero, ErrTooManyAbandoned
+	}
+
+	var state atomic.Int32
+
+	ch := make(chan struct {
+		result T
+		err    error
+	}, 1)
+
+	go func() {
+		res, err := fn()
+		ch <- struct {
+			result T
 			err    error
-		}, 1)
-
-		go func() {
-			res, err := f(arg)
-			ch <- struct {
-				result string
-				err    error
-			}{res, err}
-		}()
-
-		select {
-		case res := <-ch:
-			return res.result, res.err
-		case <-ctx.Done():
-			return "", ctx.Err()
+		}{res, err}
+
+		if !state.CompareAndSwap(callRunning, callReturned) { // Abandoned
+			n := g.abandoned.Add(-1)
+			if g.opts.OnAbandonedReturn != nil {
+				g.opts.OnAbandonedReturn(int(n), err)
+			}
 		}
+	}()
+
+	select {
+	case res := <-ch:
+		return res.result, res.err
+	case <-ctx.Done():
 	}
+
+	// Count the call as abandoned before marking it so, so that the count
+	// can't be decremented before it's incremented.
+	n := g.abandoned.Add(1)
+
+	if !state.CompareAndSwap(callRunning, callAbandoned) {
+		g.abandoned.Add(-1) // It returned after all
+		res := <-ch
+		return res.result, res.err
+	}
+
+	if g.opts.OnAbandon != nil {
+		g.opts.OnAbandon(int(n))
+	}
+
+	return zero, ctx.Err()
 }
@@ -18,6 +18,7 @@ package ch04
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 )
@@ -48,3 +49,113 @@ func Slow(s string) (string, error) {
 	time.Sleep(time.Second)
 	return "Got input: " + s, nil
 }
+
+func TestTimeoutOfInt(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	timeout := TimeoutOf(func(n int) (int, error) { return n * 2, nil })
+	res, err := timeout(ctx, 21)
+	if err != nil || res != 42 {
+		t.Fatalf("expected 42; got %d, %v", res, err)
+	}
+}
+
+// TestTimeoutWithMaxAbandoned tests that a TimeoutGuard tracks abandoned
+// calls, reports them, and refuses new calls while its cap is reached.
+func TestTimeoutWithMaxAbandoned(t *testing.T) {
+	release := make(chan struct{})
+	returned := make(chan int, 2)
+	var abandons []int
+
+	g := NewTimeoutGuard(TimeoutOptions{
+		MaxAbandoned: 2,
+		OnAbandon:    func(n int) { abandons = append(abandons, n) },
+		OnAbandonedReturn: func(n int, err error) {
+			returned <- n
+		},
+	})
+
+	timeout := TimeoutWith(g, func(s string) (string, error) {
+		<-release
+		return s, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if _, err := timeout(ctx, "some input"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("expected deadline exceeded; got", err)
+		}
+		cancel()
+	}
+
+	if n := g.Abandoned(); n != 2 || len(abandons) != 2 || abandons[1] != 2 {
+		t.Fatalf("expected 2 abandoned calls; got %d (hook saw %v)", n, abandons)
+	}
+
+	if _, err := timeout(context.Background(), "some input"); !errors.Is(err, ErrTooManyAbandoned) {
+		t.Fatal("expected ErrTooManyAbandoned; got", err)
+	}
+
+	close(release)
+
+	if n := <-returned + <-returned; n != 1 {
+		t.Errorf("expected hook to count down from 1 to 0; got %d", n)
+	}
+
+	if n := g.Abandoned(); n != 0 {
+		t.Error("expected no abandoned calls; got", n)
+	}
+
+	if _, err := timeout(context.Background(), "some input"); err != nil {
+		t.Error("expected calls to be accepted again; got", err)
+	}
+}
+
+// TestTimeoutContextWith tests that a context-aware function's context is
+// canceled when its caller stops waiting.
+func TestTimeoutContextWith(t *testing.T) {
+	canceled := make(chan error, 1)
+	g := NewTimeoutGuard(TimeoutOptions{})
+
+	timeout := TimeoutContextWith(g, func(ctx context.Context, s string) (string, error) {
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return "", ctx.Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := timeout(ctx, "some input"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected deadline exceeded; got", err)
+	}
+
+	select {
+	case err := <-canceled:
+		if err == nil {
+			t.Error("expected function's context to be done")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("function never saw cancellation")
+	}
+}
+
+// TestTimeoutContextWithCancelsOnReturn tests that the context passed to
+// the function is canceled once the call returns normally.
+func TestTimeoutContextWithCancelsOnReturn(t *testing.T) {
+	var fctx context.Context
+
+	timeout := TimeoutContextWith(NewTimeoutGuard(TimeoutOptions{}), func(ctx context.Context, s string) (string, error) {
+		fctx = ctx
+		return s, nil
+	})
+
+	if _, err := timeout(context.Background(), "some input"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if fctx.Err() == nil {
+		t.Error("expected function's context to be canceled after return")
+	}
+}
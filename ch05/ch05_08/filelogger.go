@@ -18,28 +18,114 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
-	"net/url"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Durability controls when a FileTransactionLogger acknowledges a write.
+type Durability int
+
+const (
+	// DurabilityAsync acknowledges a write as soon as it's queued. The log
+	// isn't fsynced, so acknowledged writes can be lost on power failure,
+	// and write errors are reported on Err.
+	DurabilityAsync Durability = iota
+
+	// DurabilityGroupCommit acknowledges a write once it's been fsynced.
+	// Writes that arrive within SyncInterval of each other are written
+	// together and share a single fsync.
+	DurabilityGroupCommit
+
+	// DurabilitySync writes and fsyncs each event on its own before
+	// acknowledging it.
+	DurabilitySync
+)
+
+const defaultSyncInterval = 2 * time.Millisecond
+
+// FileLoggerOptions configures a FileTransactionLogger.
+type FileLoggerOptions struct {
+	// Durability is when writes are acknowledged. The default is
+	// DurabilityAsync.
+	Durability Durability
+
+	// SyncInterval is how long DurabilityGroupCommit waits for more writes
+	// to share an fsync with. The default is 2ms.
+	SyncInterval time.Duration
+
+	// MaxSegmentSize is the size in bytes past which the active segment
+	// is rolled over. Zero means no limit.
+	MaxSegmentSize int64
+
+	// MaxSegmentAge is how long the active segment is written to before
+	// it's rolled over, counting from when the logger was opened if the
+	// segment was started earlier. Zero means no limit.
+	MaxSegmentAge time.Duration
+}
+
+// pendingEvent is a queued event. done receives the result of writing it,
+// unless the logger is asynchronous, when it's nil.
+type pendingEvent struct {
+	event Event
+	done  chan error
+}
+
 type FileTransactionLogger struct {
-	events       chan<- Event // Write-only channel for sending events
+	events       chan<- pendingEvent // Write-only channel for sending events
 	errors       <-chan error
-	lastSequence uint64   // The last used event sequence number
-	file         *os.File // The location of the transaction log
+	opts         FileLoggerOptions
+	lastSequence uint64     // The last used event sequence number
+	file         *os.File   // The active segment of the transaction log
+	mu           sync.Mutex // Guards file, which compaction replaces, and the segment fields
 	wg           *sync.WaitGroup
+
+	filename         string
+	snapshotSequence uint64 // The sequence of the latest snapshot
+
+	segments    []segment // The closed segments, in order
+	size        int64     // The size of the active segment
+	first, last uint64    // The active segment's sequence range; 0 if it's empty
+	started     time.Time // When the active segment was started or opened
+
+	// failed is set if a failed write couldn't be undone, and is returned
+	// for every later write, since appending after the torn record it
+	// left would make the log unreadable.
+	failed error
 }
 
-func (l *FileTransactionLogger) WritePut(key, value string) {
-	l.wg.Add(1)
-	l.events <- Event{EventType: EventPut, Key: key, Value: url.QueryEscape(value)}
+// writeLog writes b to the log file f. Tests replace it to inject
+// failures.
+var writeLog = (*os.File).Write
+
+func (l *FileTransactionLogger) WritePut(key, value string) error {
+	return l.write(Event{EventType: EventPut, Key: key, Value: value})
+}
+
+func (l *FileTransactionLogger) WriteDelete(key string) error {
+	return l.write(Event{EventType: EventDelete, Key: key})
 }
 
-func (l *FileTransactionLogger) WriteDelete(key string) {
+// write queues e. Unless the logger is asynchronous, it then waits for e
+// to be written and fsynced, and returns the error, if any.
+func (l *FileTransactionLogger) write(e Event) error {
+	p := pendingEvent{event: e}
+	if l.opts.Durability != DurabilityAsync {
+		p.done = make(chan error, 1)
+	}
+
 	l.wg.Add(1)
-	l.events <- Event{EventType: EventDelete, Key: key}
+	l.events <- p
+
+	if p.done == nil {
+		return nil
+	}
+
+	return <-p.done
 }
 
 func (l *FileTransactionLogger) Err() <-chan error {
@@ -47,11 +133,11 @@ func (l *FileTransactionLogger) Err() <-chan error {
 }
 
 func (l *FileTransactionLogger) LastSequence() uint64 {
-	return l.lastSequence
+	return atomic.LoadUint64(&l.lastSequence)
 }
 
 func (l *FileTransactionLogger) Run() {
-	events := make(chan Event, 16)
+	events := make(chan pendingEvent, 16)
 	l.events = events
 
 	errors := make(chan error, 1)
@@ -60,23 +146,98 @@ func (l *FileTransactionLogger) Run() {
 	// Start retrieving events from the events channel and writing them
 	// to the transaction log
 	go func() {
-		for e := range events {
-			l.lastSequence++
+		var buf []byte
+		var batch []pendingEvent
 
-			_, err := fmt.Fprintf(
-				l.file,
-				"%d\t%d\t%s\t%s\n",
-				l.lastSequence, e.EventType, e.Key, e.Value)
+		for p := range events {
+			batch = append(batch[:0], p)
+			if l.opts.Durability == DurabilityGroupCommit {
+				batch = gather(events, batch, l.opts.SyncInterval)
+			}
 
-			if err != nil {
-				errors <- fmt.Errorf("cannot write to log file: %w", err)
+			buf = buf[:0]
+			for i := range batch {
+				batch[i].event.Sequence = atomic.AddUint64(&l.lastSequence, 1)
+				buf = appendRecord(buf, batch[i].event)
 			}
 
-			l.wg.Done()
+			first, last := batch[0].event.Sequence, batch[len(batch)-1].event.Sequence
+			err := l.appendLog(buf, first, last, l.opts.Durability != DurabilityAsync)
+
+			if err != nil && l.opts.Durability == DurabilityAsync {
+				errors <- err
+			}
+
+			for _, p := range batch {
+				if p.done != nil {
+					p.done <- err
+				}
+				l.wg.Done()
+			}
 		}
 	}()
 }
 
+// gather adds the events that arrive within d to batch.
+func gather(events <-chan pendingEvent, batch []pendingEvent, d time.Duration) []pendingEvent {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		select {
+		case p, ok := <-events:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, p)
+		case <-timer.C:
+			return batch
+		}
+	}
+}
+
+// appendLog writes buf, which holds the events first to last, to the log,
+// and then fsyncs the log if fsync is true. The active segment is rolled
+// over first if it's due. If the write fails, whatever part of buf was
+// written is truncated away, so that later records don't follow a torn
+// one; if that isn't possible, every later write fails too.
+func (l *FileTransactionLogger) appendLog(buf []byte, first, last uint64, fsync bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.failed != nil {
+		return l.failed
+	}
+
+	if l.dueToRoll(len(buf)) {
+		if err := l.roll(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := writeLog(l.file, buf); err != nil {
+		if terr := l.file.Truncate(l.size); terr != nil {
+			l.failed = fmt.Errorf("transaction log unusable after failed write: %w", terr)
+		}
+		return fmt.Errorf("cannot write to log file: %w", err)
+	}
+
+	l.size += int64(len(buf))
+
+	if l.first == 0 {
+		l.first = first
+	}
+	l.last = last
+
+	if fsync {
+		if err := l.file.Sync(); err != nil {
+			return fmt.Errorf("cannot sync log file: %w", err)
+		}
+	}
+
+	return nil
+}
+
 func (l *FileTransactionLogger) Wait() {
 	l.wg.Wait()
 }
@@ -88,57 +249,346 @@ func (l *FileTransactionLogger) Close() error {
 		close(l.events) // Terminates Run loop and goroutine
 	}
 
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
 	return l.file.Close()
 }
 
 func (l *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
-	scanner := bufio.NewScanner(l.file)
 	outEvent := make(chan Event)
 	outError := make(chan error, 1)
 
 	go func() {
-		var e Event
-
 		defer close(outEvent)
 		defer close(outError)
 
-		for scanner.Scan() {
-			line := scanner.Text()
-
-			fmt.Sscanf(
-				line, "%d\t%d\t%s\t%s",
-				&e.Sequence, &e.EventType, &e.Key, &e.Value)
+		files, err := l.openSegments()
+		if err != nil {
+			outError <- fmt.Errorf("transaction log read failure: %w", err)
+			return
+		}
 
-			if l.lastSequence >= e.Sequence {
-				outError <- fmt.Errorf("transaction numbers out of sequence")
-				return
+		defer func() {
+			for _, f := range files {
+				f.Close()
 			}
+		}()
+
+		var last uint64
 
-			uv, err := url.QueryUnescape(e.Value)
+		for _, file := range files {
+			info, err := file.Stat()
 			if err != nil {
-				outError <- fmt.Errorf("value decoding failure: %w", err)
+				outError <- fmt.Errorf("transaction log read failure: %w", err)
 				return
 			}
 
-			e.Value = uv
-			l.lastSequence = e.Sequence
+			// The active segment may still be growing, so read only as far
+			// as its current size.
+			r := bufio.NewReader(io.NewSectionReader(file, logHeaderSize, info.Size()-logHeaderSize))
 
-			outEvent <- e
-		}
+			for {
+				e, _, err := readRecord(r)
+				if err == io.EOF || err == errTornRecord {
+					break // A torn record can only be a write in progress
+				}
+				if err != nil {
+					outError <- fmt.Errorf("transaction log read failure: %w", err)
+					return
+				}
 
-		if err := scanner.Err(); err != nil {
-			outError <- fmt.Errorf("transaction log read failure: %w", err)
+				if last >= e.Sequence {
+					outError <- fmt.Errorf("transaction numbers out of sequence")
+					return
+				}
+				last = e.Sequence
+
+				outEvent <- e
+			}
 		}
 	}()
 
 	return outEvent, outError
 }
 
+// openSegments opens each closed segment, in order, followed by the active
+// segment. They're opened together, so that rolling over, compaction and
+// the removal of old segments can't change the set of files while they're
+// being read.
+func (l *FileTransactionLogger) openSegments() ([]*os.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var files []*os.File
+
+	names := make([]string, 0, len(l.segments)+1)
+	for _, s := range l.segments {
+		names = append(names, segmentFilename(l.filename, s.number))
+	}
+	names = append(names, l.filename)
+
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+// ReadSnapshot returns the latest snapshot written by WriteSnapshot.
+func (l *FileTransactionLogger) ReadSnapshot() (Snapshot, bool, error) {
+	return readSnapshot(snapshotFilename(l.filename))
+}
+
+// WriteSnapshot stores s in a file next to the log, replacing any earlier
+// snapshot, and then compacts the log. s.Sequence must be no more than
+// LastSequence, and every event up to it must be reflected in s.Data.
+func (l *FileTransactionLogger) WriteSnapshot(s Snapshot) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if s.Sequence < l.snapshotSequence {
+		return fmt.Errorf("snapshot at %d is older than the latest, at %d", s.Sequence, l.snapshotSequence)
+	}
+
+	if err := replaceFile(snapshotFilename(l.filename), encodeSnapshot(s)); err != nil {
+		return fmt.Errorf("cannot write snapshot file: %w", err)
+	}
+
+	l.snapshotSequence = s.Sequence
+
+	if err := l.removeSegments(); err != nil {
+		return err
+	}
+
+	return l.compact()
+}
+
+// Compact rewrites the log without the events that the latest snapshot
+// includes, or that are superseded by a later event for the same key.
+func (l *FileTransactionLogger) Compact() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.compact()
+}
+
+// compact implements Compact. Must be called with l.mu held.
+func (l *FileTransactionLogger) compact() error {
+	info, err := l.file.Stat()
+	if err != nil {
+		return fmt.Errorf("transaction log read failure: %w", err)
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(l.file, logHeaderSize, info.Size()-logHeaderSize))
+
+	var events []Event
+	var first, last uint64
+	latest := make(map[string]int) // The index of each key's latest event
+
+	for {
+		e, _, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("transaction log read failure: %w", err)
+		}
+
+		if e.Sequence > l.snapshotSequence {
+			latest[e.Key] = len(events)
+			events = append(events, e)
+		}
+	}
+
+	buf := logHeader()
+
+	for i, e := range events {
+		if latest[e.Key] != i {
+			continue // Superseded
+		}
+
+		// With no snapshot or earlier segment, there's nothing for a
+		// delete to remove.
+		if e.EventType == EventDelete && l.snapshotSequence == 0 && len(l.segments) == 0 {
+			continue
+		}
+
+		buf = appendRecord(buf, e)
+
+		if first == 0 {
+			first = e.Sequence
+		}
+		last = e.Sequence
+	}
+
+	if err := replaceFile(l.filename, buf); err != nil {
+		return fmt.Errorf("cannot compact transaction log: %w", err)
+	}
+
+	file, err := openLogFile(l.filename)
+	if err != nil {
+		return err
+	}
+
+	l.file.Close()
+	l.file = file
+	l.size = int64(len(buf))
+	l.first, l.last = first, last
+
+	return nil
+}
+
+// NewFileTransactionLogger opens the transaction log at filename, creating
+// it if necessary. A log in the legacy text format is first migrated to
+// the current format, and a torn record at the end of the log, left by an
+// interrupted write, is truncated away. Writes are asynchronous; use
+// NewFileTransactionLoggerWithOptions for durable writes.
 func NewFileTransactionLogger(filename string) (TransactionLogger, error) {
+	return NewFileTransactionLoggerWithOptions(filename, FileLoggerOptions{})
+}
+
+// NewFileTransactionLoggerWithOptions is like NewFileTransactionLogger,
+// but configured by opts.
+func NewFileTransactionLoggerWithOptions(filename string, opts FileLoggerOptions) (TransactionLogger, error) {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = defaultSyncInterval
+	}
+
+	file, err := openLogFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, logHeaderSize)
+	n, _ := file.ReadAt(header, 0)
+
+	if n > 0 && !bytes.HasPrefix(header[:n], []byte(logMagic)[:min(n, len(logMagic))]) {
+		file.Close()
+
+		if err := migrateLegacyLog(filename); err != nil {
+			return nil, err
+		}
+
+		if file, err = openLogFile(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	l := &FileTransactionLogger{file: file, wg: &sync.WaitGroup{}, filename: filename, opts: opts, started: time.Now()}
+
+	if err := l.repair(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Sequence numbers carry on from the snapshot's, even if compaction
+	// has left the log empty.
+	if l.snapshotSequence, err = readSnapshotSequence(snapshotFilename(filename)); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if l.segments, err = loadSegments(filename); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	l.lastSequence = max(l.last, l.snapshotSequence)
+	if len(l.segments) > 0 {
+		l.lastSequence = max(l.lastSequence, l.segments[len(l.segments)-1].last)
+	}
+
+	return l, nil
+}
+
+func openLogFile(filename string) (*os.File, error) {
 	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open transaction log file: %w", err)
 	}
 
-	return &FileTransactionLogger{file: file, wg: &sync.WaitGroup{}}, nil
+	return file, nil
+}
+
+// repair writes the header to a new log, checks an existing log's header,
+// and truncates a torn record from the end of the log. It records
+// the size and sequence range of what remains.
+func (l *FileTransactionLogger) repair() error {
+	info, err := l.file.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat transaction log file: %w", err)
+	}
+
+	// A log shorter than a header was torn while being created.
+	if info.Size() < logHeaderSize {
+		if err := l.file.Truncate(0); err != nil {
+			return fmt.Errorf("cannot repair transaction log file: %w", err)
+		}
+		if _, err := l.file.Write(logHeader()); err != nil {
+			return fmt.Errorf("cannot write to log file: %w", err)
+		}
+		l.size = logHeaderSize
+		return l.file.Sync()
+	}
+
+	header := make([]byte, logHeaderSize)
+	if _, err := l.file.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("transaction log read failure: %w", err)
+	}
+	if err := checkLogHeader(header); err != nil {
+		return err
+	}
+
+	size := info.Size() - logHeaderSize
+
+	end, first, last, err := scanLog(io.NewSectionReader(l.file, logHeaderSize, size), size)
+	if err != nil {
+		return err
+	}
+
+	if end < size {
+		if err := l.file.Truncate(logHeaderSize + end); err != nil {
+			return fmt.Errorf("cannot repair transaction log file: %w", err)
+		}
+	}
+
+	l.size = logHeaderSize + end
+	l.first, l.last = first, last
+
+	return nil
+}
+
+// migrateLegacyLog rewrites the legacy text log at filename in the current
+// format. The new log replaces the old one atomically, so an interrupted
+// migration leaves the legacy log in place to be migrated again.
+func migrateLegacyLog(filename string) error {
+	legacy, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+	defer legacy.Close()
+
+	events, err := readLegacyLog(legacy)
+	if err != nil {
+		return fmt.Errorf("cannot migrate legacy transaction log: %w", err)
+	}
+
+	buf := logHeader()
+	for _, e := range events {
+		buf = appendRecord(buf, e)
+	}
+
+	if err := replaceFile(filename, buf); err != nil {
+		return fmt.Errorf("cannot migrate legacy transaction log: %w", err)
+	}
+
+	return nil
 }
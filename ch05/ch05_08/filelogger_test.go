@@ -17,8 +17,13 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func fileExists(filename string) bool {
@@ -152,6 +157,482 @@ func TestWritePut(t *testing.T) {
 	}
 }
 
+func TestWriteAwkwardKeys(t *testing.T) {
+	const filename = "/tmp/write-awkward-keys.txt"
+	defer os.Remove(filename)
+
+	expected := []Event{
+		{Sequence: 1, EventType: EventPut, Key: "my key", Value: "my value"},
+		{Sequence: 2, EventType: EventPut, Key: "tab\tand\nnewline", Value: "%20 100%"},
+		{Sequence: 3, EventType: EventDelete, Key: "my key"},
+	}
+
+	tl, _ := NewFileTransactionLogger(filename)
+	tl.Run()
+
+	for _, e := range expected {
+		if e.EventType == EventPut {
+			tl.WritePut(e.Key, e.Value)
+		} else {
+			tl.WriteDelete(e.Key)
+		}
+	}
+	tl.Close()
+
+	events := readAllEvents(t, filename)
+
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events; got %d", len(expected), len(events))
+	}
+
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Errorf("Event mismatch (expected %v; got %v)", expected[i], events[i])
+		}
+	}
+}
+
+func TestRepairTornTail(t *testing.T) {
+	const filename = "/tmp/repair-torn-tail.txt"
+	defer os.Remove(filename)
+
+	tl, _ := NewFileTransactionLogger(filename)
+	tl.Run()
+	tl.WritePut("my-key", "my-value")
+	tl.WritePut("my-key", "my-value2")
+	tl.WritePut("my-key", "my-value3")
+	tl.Close()
+
+	// Simulate a write torn by a crash.
+	info, _ := os.Stat(filename)
+	os.Truncate(filename, info.Size()-3)
+
+	tl2, err := NewFileTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evaluateLastSequence(t, tl2, 2)
+
+	tl2.Run()
+	tl2.WritePut("my-key", "my-value4")
+	tl2.Close()
+
+	events := readAllEvents(t, filename)
+
+	if len(events) != 3 || events[2].Sequence != 3 || events[2].Value != "my-value4" {
+		t.Errorf("Expected torn record to be replaced; got %v", events)
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	const filename = "/tmp/corrupt-record.txt"
+	defer os.Remove(filename)
+
+	tl, _ := NewFileTransactionLogger(filename)
+	tl.Run()
+	tl.WritePut("my-key", "my-value")
+	tl.WritePut("my-key", "my-value2")
+	tl.Close()
+
+	// Damage the first record's value, which isn't at the end of the log.
+	data, _ := os.ReadFile(filename)
+	data[logHeaderSize+recordHeaderSize+5] ^= 0xff
+	os.WriteFile(filename, data, 0755)
+
+	if _, err := NewFileTransactionLogger(filename); !errors.Is(err, ErrorCorruptLog) {
+		t.Errorf("Expected ErrorCorruptLog; got %v", err)
+	}
+}
+
+func TestCorruptRecordLength(t *testing.T) {
+	const filename = "/tmp/corrupt-record-length.txt"
+	defer os.Remove(filename)
+
+	tl, _ := NewFileTransactionLoggerWithOptions(filename, FileLoggerOptions{Durability: DurabilitySync})
+	tl.Run()
+	tl.WritePut("my-key", "my-value")
+	tl.WritePut("my-key", "my-value2")
+	tl.WritePut("my-key", "my-value3")
+	tl.Close()
+
+	// Damage the second record's length, which isn't at the end of the log.
+	first := appendRecord(nil, Event{Sequence: 1, EventType: EventPut, Key: "my-key", Value: "my-value"})
+	data, _ := os.ReadFile(filename)
+	data[logHeaderSize+len(first)+3] ^= 0xff
+	os.WriteFile(filename, data, 0755)
+
+	if _, err := NewFileTransactionLogger(filename); !errors.Is(err, ErrorCorruptLog) {
+		t.Errorf("Expected ErrorCorruptLog; got %v", err)
+	}
+
+	if info, _ := os.Stat(filename); info.Size() != int64(len(data)) {
+		t.Errorf("Expected the log to be left as it was; got %d bytes, not %d", info.Size(), len(data))
+	}
+}
+
+func TestMigrateLegacyLog(t *testing.T) {
+	const filename = "/tmp/migrate-legacy-log.txt"
+	defer os.Remove(filename)
+
+	legacy := "1\t2\tmy key\tmy+value\n" +
+		"2\t2\tother-key\t100%25\n" +
+		"3\t1\tmy key\t\n" +
+		"4\t2\ttorn" // An interrupted final write
+
+	os.WriteFile(filename, []byte(legacy), 0755)
+
+	events := readAllEvents(t, filename)
+
+	expected := []Event{
+		{Sequence: 1, EventType: EventPut, Key: "my key", Value: "my value"},
+		{Sequence: 2, EventType: EventPut, Key: "other-key", Value: "100%"},
+		{Sequence: 3, EventType: EventDelete, Key: "my key"},
+	}
+
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events; got %d", len(expected), len(events))
+	}
+
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Errorf("Event mismatch (expected %v; got %v)", expected[i], events[i])
+		}
+	}
+
+	data, _ := os.ReadFile(filename)
+	if string(data[:len(logMagic)]) != logMagic {
+		t.Error("Expected log to be migrated to the binary format")
+	}
+}
+
+func TestSnapshotAndCompact(t *testing.T) {
+	const filename = "/tmp/snapshot-and-compact.txt"
+	defer os.Remove(filename)
+	defer os.Remove(snapshotFilename(filename))
+
+	tl, _ := NewFileTransactionLogger(filename)
+	tl.Run()
+	tl.WritePut("a", "1")
+	tl.WritePut("b", "2")
+	tl.Wait()
+
+	snapshot := Snapshot{Sequence: tl.LastSequence(), Data: map[string]string{"a": "1", "b": "2"}}
+	if err := tl.(Snapshotter).WriteSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	tl.WritePut("a", "3")
+	tl.WritePut("a", "4")
+	tl.WriteDelete("b")
+	tl.Close()
+
+	tl2, _ := NewFileTransactionLogger(filename)
+	defer tl2.Close()
+
+	got, ok, err := tl2.(Snapshotter).ReadSnapshot()
+	if err != nil || !ok {
+		t.Fatalf("Expected a snapshot; got %v, %v", ok, err)
+	}
+
+	if got.Sequence != 2 || len(got.Data) != 2 || got.Data["b"] != "2" {
+		t.Errorf("Snapshot mismatch (expected %v; got %v)", snapshot, got)
+	}
+
+	if err := tl2.(*FileTransactionLogger).Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := readAllEvents(t, filename)
+
+	// Only the latest PUT for a and the DELETE for b remain.
+	if len(events) != 2 || events[0].Sequence != 4 || events[1].Sequence != 5 {
+		t.Errorf("Expected events 4 and 5; got %v", events)
+	}
+}
+
+func TestSnapshotSequenceContinues(t *testing.T) {
+	const filename = "/tmp/snapshot-sequence-continues.txt"
+	defer os.Remove(filename)
+	defer os.Remove(snapshotFilename(filename))
+
+	tl, _ := NewFileTransactionLogger(filename)
+	tl.Run()
+	tl.WritePut("a", "1")
+	tl.WritePut("a", "2")
+	tl.Wait()
+	tl.(Snapshotter).WriteSnapshot(Snapshot{Sequence: 2, Data: map[string]string{"a": "2"}})
+	tl.Close()
+
+	// The log is now empty, but numbering carries on from the snapshot.
+	tl2, _ := NewFileTransactionLogger(filename)
+	defer tl2.Close()
+
+	evaluateLastSequence(t, tl2, 2)
+}
+
+func TestDurableWrites(t *testing.T) {
+	modes := map[string]Durability{
+		"group-commit": DurabilityGroupCommit,
+		"sync":         DurabilitySync,
+	}
+
+	for name, durability := range modes {
+		t.Run(name, func(t *testing.T) {
+			filename := "/tmp/durable-writes-" + name + ".txt"
+			defer os.Remove(filename)
+
+			tl, err := NewFileTransactionLoggerWithOptions(filename, FileLoggerOptions{Durability: durability})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tl.Close()
+			tl.Run()
+
+			const writers = 50
+
+			var wg sync.WaitGroup
+			for i := range writers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := tl.WritePut(fmt.Sprint("key-", i), "value"); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			// Every acknowledged write is already in the log, without
+			// waiting for the logger.
+			events := readAllEvents(t, filename)
+			if len(events) != writers {
+				t.Fatalf("Expected %d events; got %d", writers, len(events))
+			}
+
+			for i, e := range events {
+				if e.Sequence != uint64(i+1) {
+					t.Errorf("Expected sequence %d; got %d", i+1, e.Sequence)
+				}
+			}
+		})
+	}
+}
+
+func TestDurableWriteError(t *testing.T) {
+	const filename = "/tmp/durable-write-error.txt"
+	defer os.Remove(filename)
+
+	tl, err := NewFileTransactionLoggerWithOptions(filename, FileLoggerOptions{Durability: DurabilitySync})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	tl.Run()
+
+	if err := tl.WritePut("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the next write fail.
+	tl.(*FileTransactionLogger).file.Close()
+
+	if err := tl.WritePut("a", "2"); err == nil {
+		t.Error("Expected an error from WritePut")
+	}
+	if err := tl.WriteDelete("a"); err == nil {
+		t.Error("Expected an error from WriteDelete")
+	}
+
+	// Errors go to the caller, not to Err.
+	select {
+	case err := <-tl.Err():
+		t.Errorf("Unexpected error on Err: %v", err)
+	default:
+	}
+}
+
+func TestSegmentRollover(t *testing.T) {
+	const filename = "/tmp/segment-rollover.txt"
+	defer removeLogFiles(filename)
+
+	tl, _ := NewFileTransactionLoggerWithOptions(filename, FileLoggerOptions{MaxSegmentSize: 64})
+	tl.Run()
+	for i := range 20 {
+		tl.WritePut(fmt.Sprint("key-", i), "value")
+	}
+	tl.Wait()
+	tl.Close()
+
+	segments, _ := segmentNumbers(filename)
+	if len(segments) < 2 {
+		t.Fatalf("Expected the log to roll over; got %d segments", len(segments))
+	}
+
+	events := readAllEvents(t, filename)
+	if len(events) != 20 || events[19].Sequence != 20 {
+		t.Fatalf("Expected 20 events across segments; got %v", events)
+	}
+
+	// The index is rebuilt if it's lost.
+	os.Remove(indexFilename(filename))
+
+	tl2, err := NewFileTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl2.Close()
+
+	evaluateLastSequence(t, tl2, 20)
+
+	if !fileExists(indexFilename(filename)) {
+		t.Error("Expected the segment index to be rebuilt")
+	}
+}
+
+func TestSegmentRolloverByAge(t *testing.T) {
+	const filename = "/tmp/segment-rollover-by-age.txt"
+	defer removeLogFiles(filename)
+
+	tl, _ := NewFileTransactionLoggerWithOptions(filename, FileLoggerOptions{
+		Durability:    DurabilitySync,
+		MaxSegmentAge: 10 * time.Millisecond,
+	})
+	defer tl.Close()
+	tl.Run()
+
+	tl.WritePut("a", "1")
+	tl.WritePut("b", "2")
+	time.Sleep(20 * time.Millisecond)
+	tl.WritePut("c", "3")
+
+	segments := tl.(*FileTransactionLogger).segments
+	if len(segments) != 1 || segments[0].first != 1 || segments[0].last != 2 {
+		t.Errorf("Expected one segment holding events 1 to 2; got %v", segments)
+	}
+}
+
+func TestSnapshotRemovesSegments(t *testing.T) {
+	const filename = "/tmp/snapshot-removes-segments.txt"
+	defer removeLogFiles(filename)
+
+	tl, _ := NewFileTransactionLoggerWithOptions(filename, FileLoggerOptions{
+		Durability:     DurabilitySync,
+		MaxSegmentSize: 64,
+	})
+	tl.Run()
+
+	data := make(map[string]string)
+	for i := range 20 {
+		key := fmt.Sprint("key-", i)
+		tl.WritePut(key, "value")
+		if i < 15 {
+			data[key] = "value"
+		}
+	}
+
+	before := len(tl.(*FileTransactionLogger).segments)
+
+	if err := tl.(Snapshotter).WriteSnapshot(Snapshot{Sequence: 15, Data: data}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tl.(*FileTransactionLogger).segments) >= before {
+		t.Errorf("Expected segments to be removed; %d before and %d after", before, len(tl.(*FileTransactionLogger).segments))
+	}
+
+	for _, s := range tl.(*FileTransactionLogger).segments {
+		if s.last <= 15 {
+			t.Errorf("Expected segment %d, up to event %d, to be removed", s.number, s.last)
+		}
+	}
+	tl.Close()
+
+	numbers, _ := segmentNumbers(filename)
+	if len(numbers) != len(tl.(*FileTransactionLogger).segments) {
+		t.Errorf("Expected %d segment files; got %d", len(tl.(*FileTransactionLogger).segments), len(numbers))
+	}
+
+	// Every event after the snapshot is still there.
+	var after []uint64
+	for _, e := range readAllEvents(t, filename) {
+		if e.Sequence > 15 {
+			after = append(after, e.Sequence)
+		}
+	}
+
+	if len(after) != 5 || after[0] != 16 {
+		t.Errorf("Expected events 16 to 20; got %v", after)
+	}
+}
+
+func TestShortWrite(t *testing.T) {
+	const filename = "/tmp/short-write.txt"
+	defer os.Remove(filename)
+
+	tl, _ := NewFileTransactionLoggerWithOptions(filename, FileLoggerOptions{Durability: DurabilitySync})
+	tl.Run()
+
+	if err := tl.WritePut("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write only half of the next record.
+	writeLog = func(f *os.File, b []byte) (int, error) {
+		n, _ := f.Write(b[:len(b)/2])
+		return n, errors.New("short write")
+	}
+
+	err := tl.WritePut("b", "2")
+	writeLog = (*os.File).Write
+
+	if err == nil {
+		t.Error("Expected an error from the short write")
+	}
+
+	if err := tl.WritePut("c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	tl.Close()
+
+	// The torn record was removed, so the log still opens.
+	events := readAllEvents(t, filename)
+	if len(events) != 2 || events[0].Key != "a" || events[1].Key != "c" {
+		t.Errorf("Expected events for a and c; got %v", events)
+	}
+}
+
+// removeLogFiles removes the log at filename, with its segments, index and
+// snapshot.
+func removeLogFiles(filename string) {
+	names, _ := filepath.Glob(filename + "*")
+	for _, name := range names {
+		os.Remove(name)
+	}
+}
+
+// readAllEvents opens the log at filename and returns all of its events.
+func readAllEvents(t *testing.T, filename string) []Event {
+	tl, err := NewFileTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	var events []Event
+
+	chev, cherr := tl.ReadEvents()
+	for e := range chev {
+		events = append(events, e)
+	}
+
+	if err := <-cherr; err != nil {
+		t.Error(err)
+	}
+
+	return events
+}
+
 func evaluateLastSequence(t *testing.T, el TransactionLogger, expected uint64) {
 	if ls := el.LastSequence(); ls != expected {
 		t.Errorf("Last sequence mismatch (expected %d; got %d)", expected, ls)
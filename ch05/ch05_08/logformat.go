@@ -0,0 +1,266 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// A transaction log file starts with an 8-byte header: the magic string
+// "KVTL", a format version byte, and three reserved bytes. It's followed
+// by records, each of which is:
+//
+//	length   uint32  Length of the payload, little-endian
+//	checksum uint32  CRC-32C of the payload, little-endian
+//	payload:
+//	  sequence   uvarint
+//	  event type byte
+//	  key length uvarint, followed by the key
+//	  value length uvarint, followed by the value
+//
+// Keys and values are stored as-is, so they can contain any bytes.
+
+const (
+	logMagic         = "KVTL"
+	logVersion       = 1
+	logHeaderSize    = 8
+	recordHeaderSize = 8
+	maxRecordSize    = 64 << 20 // Larger lengths can only be garbage
+)
+
+var (
+	ErrorCorruptLog         = errors.New("transaction log is corrupt")
+	ErrorUnsupportedVersion = errors.New("unsupported transaction log version")
+
+	// errTornRecord means that a record ends past the end of the file, as
+	// happens when a write is interrupted.
+	errTornRecord = errors.New("torn record")
+
+	// errBadChecksum means that a record's payload doesn't match its
+	// checksum.
+	errBadChecksum = errors.New("record checksum mismatch")
+
+	// errBadLength means that a record's length is larger than any record
+	// that could have been written.
+	errBadLength = errors.New("record length out of range")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// logHeader returns the header for a new log file.
+func logHeader() []byte {
+	header := make([]byte, logHeaderSize)
+	copy(header, logMagic)
+	header[len(logMagic)] = logVersion
+	return header
+}
+
+// checkLogHeader returns an error unless header is a supported log header.
+func checkLogHeader(header []byte) error {
+	if len(header) < logHeaderSize || string(header[:len(logMagic)]) != logMagic {
+		return fmt.Errorf("%w: bad header", ErrorCorruptLog)
+	}
+
+	if v := header[len(logMagic)]; v != logVersion {
+		return fmt.Errorf("%w: %d", ErrorUnsupportedVersion, v)
+	}
+
+	return nil
+}
+
+// appendRecord appends the encoding of e to buf.
+func appendRecord(buf []byte, e Event) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, recordHeaderSize)...)
+
+	buf = binary.AppendUvarint(buf, e.Sequence)
+	buf = append(buf, byte(e.EventType))
+	buf = binary.AppendUvarint(buf, uint64(len(e.Key)))
+	buf = append(buf, e.Key...)
+	buf = binary.AppendUvarint(buf, uint64(len(e.Value)))
+	buf = append(buf, e.Value...)
+
+	payload := buf[start+recordHeaderSize:]
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[start+4:], crc32.Checksum(payload, crcTable))
+
+	return buf
+}
+
+// readRecord reads the next record from r, and returns its event and its
+// encoded size. It returns io.EOF if r is at a clean end, errTornRecord if
+// the record is incomplete, errBadLength with the size of the record
+// header if its length is out of range, errBadChecksum if its payload is
+// damaged, and any other error from r as-is.
+func readRecord(r *bufio.Reader) (Event, int64, error) {
+	var header [recordHeaderSize]byte
+
+	if _, err := io.ReadFull(r, header[:]); err == io.ErrUnexpectedEOF {
+		return Event{}, 0, errTornRecord
+	} else if err != nil {
+		return Event{}, 0, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[:])
+	if length > maxRecordSize {
+		return Event{}, recordHeaderSize, errBadLength
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return Event{}, 0, errTornRecord
+	} else if err != nil {
+		return Event{}, 0, err
+	}
+
+	size := int64(recordHeaderSize + length)
+
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+		return Event{}, size, errBadChecksum
+	}
+
+	e, err := decodePayload(payload)
+	if err != nil {
+		return Event{}, size, err
+	}
+
+	return e, size, nil
+}
+
+// decodePayload decodes a record's payload.
+func decodePayload(p []byte) (Event, error) {
+	var e Event
+
+	seq, n := binary.Uvarint(p)
+	if n <= 0 || len(p) < n+1 {
+		return e, fmt.Errorf("%w: bad record payload", ErrorCorruptLog)
+	}
+	e.Sequence, e.EventType, p = seq, EventType(p[n]), p[n+1:]
+
+	var fields [2]string
+	for i := range fields {
+		length, n := binary.Uvarint(p)
+		if n <= 0 || uint64(len(p)-n) < length {
+			return e, fmt.Errorf("%w: bad record payload", ErrorCorruptLog)
+		}
+		fields[i], p = string(p[n:n+int(length)]), p[n+int(length):]
+	}
+	e.Key, e.Value = fields[0], fields[1]
+
+	return e, nil
+}
+
+// scanLog reads every record from r, which starts after the header, and
+// returns the offset from the start of r at which the valid records end,
+// and the first and last sequence numbers. A record that runs past the end
+// of the log, or a damaged record with nothing after it, is assumed to be
+// a torn write, and the offset returned is its start. A damaged record
+// with anything after it is reported as corruption.
+func scanLog(r io.Reader, size int64) (end int64, first, last uint64, err error) {
+	br := bufio.NewReader(r)
+
+	for {
+		e, n, err := readRecord(br)
+
+		switch {
+		case err == io.EOF, err == errTornRecord:
+			return end, first, last, nil
+
+		case (err == errBadChecksum || err == errBadLength) && end+n == size:
+			return end, first, last, nil
+
+		case err == errBadChecksum, err == errBadLength:
+			return end, first, last, fmt.Errorf("%w: record at offset %d: %w", ErrorCorruptLog, end, err)
+
+		case err != nil:
+			return end, first, last, err
+		}
+
+		if end == 0 {
+			first = e.Sequence
+		}
+
+		end += n
+		last = e.Sequence
+	}
+}
+
+// readLegacyLog reads a log written in the original text format, one event
+// per line as "%d\t%d\t%s\t%s" with the value URL-escaped. Keys are taken
+// to run to the next tab, so those containing spaces are read correctly. A
+// malformed final line is assumed to be a torn write, and is dropped.
+func readLegacyLog(r io.Reader) ([]Event, error) {
+	var events []Event
+	var pending error // An error on a line that may turn out to be the last
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxRecordSize)
+
+	for line := 1; scanner.Scan(); line++ {
+		if pending != nil {
+			return nil, pending
+		}
+
+		e, err := parseLegacyLine(scanner.Text())
+		if err != nil {
+			pending = fmt.Errorf("%w: line %d: %w", ErrorCorruptLog, line, err)
+			continue
+		}
+
+		events = append(events, e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("transaction log read failure: %w", err)
+	}
+
+	return events, nil
+}
+
+func parseLegacyLine(line string) (Event, error) {
+	var e Event
+
+	fields := strings.SplitN(line, "\t", 4)
+	if len(fields) != 4 {
+		return e, fmt.Errorf("expected 4 fields; got %d", len(fields))
+	}
+
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return e, err
+	}
+
+	typ, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return e, err
+	}
+
+	value, err := url.QueryUnescape(fields[3])
+	if err != nil {
+		return e, fmt.Errorf("value decoding failure: %w", err)
+	}
+
+	return Event{Sequence: seq, EventType: EventType(typ), Key: fields[2], Value: value}, nil
+}
@@ -32,8 +32,12 @@ type Event struct {
 }
 
 type TransactionLogger interface {
-	WriteDelete(key string)
-	WritePut(key, value string)
+	// WriteDelete and WritePut log an event. A logger that acknowledges
+	// writes synchronously returns only once the event is durable, and
+	// returns any error; otherwise they return nil, and errors are
+	// reported on Err.
+	WriteDelete(key string) error
+	WritePut(key, value string) error
 	Err() <-chan error
 
 	LastSequence() uint64
@@ -44,3 +48,22 @@ type TransactionLogger interface {
 
 	ReadEvents() (<-chan Event, <-chan error)
 }
+
+// Snapshot is a copy of the store's contents that includes every event up
+// to and including Sequence.
+type Snapshot struct {
+	Sequence uint64
+	Data     map[string]string
+}
+
+// Snapshotter is implemented by TransactionLoggers that can store
+// snapshots, so that restoring the store needn't replay every event.
+type Snapshotter interface {
+	// WriteSnapshot stores s, replacing any earlier snapshot, and then
+	// compacts the log, dropping the events that s includes.
+	WriteSnapshot(s Snapshot) error
+
+	// ReadSnapshot returns the latest snapshot. ok is false if there
+	// isn't one.
+	ReadSnapshot() (s Snapshot, ok bool, err error)
+}
@@ -39,14 +39,16 @@ type PostgresTransactionLogger struct {
 	wg     *sync.WaitGroup
 }
 
-func (l *PostgresTransactionLogger) WritePut(key, value string) {
+func (l *PostgresTransactionLogger) WritePut(key, value string) error {
 	l.wg.Add(1)
 	l.events <- Event{EventType: EventPut, Key: key, Value: url.QueryEscape(value)}
+	return nil
 }
 
-func (l *PostgresTransactionLogger) WriteDelete(key string) {
+func (l *PostgresTransactionLogger) WriteDelete(key string) error {
 	l.wg.Add(1)
 	l.events <- Event{EventType: EventDelete, Key: key}
+	return nil
 }
 
 func (l *PostgresTransactionLogger) Err() <-chan error {
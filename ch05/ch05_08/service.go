@@ -19,15 +19,46 @@ package main
 import (
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"log"
+	"maps"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 var transact TransactionLogger
 
+// Each write is logged before it's applied to the store, so that a write
+// that fails to log is never seen. writes is held for reading from before
+// an event is logged until it's applied, and for writing by writeSnapshot,
+// so that a snapshot never misses an event that's logged but not yet
+// applied. keyLocks serializes the writes to each key, so that they're
+// applied in the order they're logged.
+var (
+	writes   sync.RWMutex
+	keyLocks [64]sync.Mutex
+)
+
+// lockForWrite locks key for a write, and returns the function that
+// unlocks it.
+func lockForWrite(key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	mu := &keyLocks[h.Sum32()%uint32(len(keyLocks))]
+
+	writes.RLock()
+	mu.Lock()
+
+	return func() {
+		mu.Unlock()
+		writes.RUnlock()
+	}
+}
+
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Println(r.Method, r.RequestURI)
@@ -50,13 +81,20 @@ func keyValuePutHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	err = Put(key, string(value))
+	unlock := lockForWrite(key)
+	defer unlock()
+
+	err = transact.WritePut(key, string(value))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	transact.WritePut(key, string(value))
+	err = Put(key, string(value))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusCreated)
 
@@ -86,13 +124,20 @@ func keyValueDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
 
-	err := Delete(key)
+	unlock := lockForWrite(key)
+	defer unlock()
+
+	err := transact.WriteDelete(key)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	transact.WriteDelete(key)
+	err = Delete(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	log.Printf("DELETE key=%s\n", key)
 }
@@ -110,6 +155,21 @@ func initializeTransactionLog() error {
 		return fmt.Errorf("failed to create transaction logger: %w", err)
 	}
 
+	// Start from the latest snapshot, if there is one, and replay only the
+	// events that came after it.
+	var snapshot Snapshot
+
+	if s, isSnapshotter := transact.(Snapshotter); isSnapshotter {
+		snapshot, _, err = s.ReadSnapshot()
+		if err != nil {
+			return fmt.Errorf("failed to read snapshot: %w", err)
+		}
+
+		for k, v := range snapshot.Data {
+			Put(k, v)
+		}
+	}
+
 	events, errors := transact.ReadEvents()
 	count, ok, e := 0, true, Event{}
 
@@ -118,6 +178,10 @@ func initializeTransactionLog() error {
 		case err, ok = <-errors:
 
 		case e, ok = <-events:
+			if e.Sequence <= snapshot.Sequence {
+				continue // Already included in the snapshot
+			}
+
 			switch e.EventType {
 			case EventDelete: // Got a DELETE event!
 				err = Delete(e.Key)
@@ -129,7 +193,7 @@ func initializeTransactionLog() error {
 		}
 	}
 
-	log.Printf("%d events replayed\n", count)
+	log.Printf("%d events replayed after snapshot at %d\n", count, snapshot.Sequence)
 
 	transact.Run()
 
@@ -139,9 +203,43 @@ func initializeTransactionLog() error {
 		}
 	}()
 
+	if s, isSnapshotter := transact.(Snapshotter); isSnapshotter {
+		go func() {
+			for range time.Tick(snapshotInterval) {
+				if err := writeSnapshot(s); err != nil {
+					log.Print(err)
+				}
+			}
+		}()
+	}
+
 	return err
 }
 
+// snapshotInterval is how often the store is snapshotted, if the
+// transaction logger supports it.
+const snapshotInterval = 10 * time.Minute
+
+// writeSnapshot snapshots the store. Writes are paused while the sequence
+// is read and the store copied, so every event up to the sequence has been
+// applied to the store. Any that are applied but not yet sequenced, as
+// asynchronous writes can be, are simply replayed again on restore.
+func writeSnapshot(s Snapshotter) error {
+	writes.Lock()
+	seq := transact.LastSequence()
+
+	store.RLock()
+	data := maps.Clone(store.m)
+	store.RUnlock()
+	writes.Unlock()
+
+	if err := s.WriteSnapshot(Snapshot{Sequence: seq, Data: data}); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	return nil
+}
+
 func main() {
 	// Initializes the transaction log and loads existing data, if any.
 	// Blocks until all data is read.
@@ -18,18 +18,35 @@ package core
 
 import (
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"maps"
 	"sync"
+	"time"
 )
 
 type KeyValueStore struct {
 	sync.RWMutex
 	m        map[string]string
 	transact TransactionLogger
+
+	// Each write is logged before it's applied to m, so that a write that
+	// fails to log is never seen. writes is held for reading from before
+	// an event is logged until it's applied, and for writing by
+	// WriteSnapshot, so that a snapshot never misses an event that's
+	// logged but not yet applied. keyLocks serializes the writes to each
+	// key, so that they're applied in the order they're logged.
+	writes   sync.RWMutex
+	keyLocks [64]sync.Mutex
+
+	snapshotInterval time.Duration
 }
 
 var ErrorNoSuchKey = errors.New("no such key")
 
+var ErrorSnapshotsNotSupported = errors.New("transaction logger doesn't support snapshots")
+
 func NewKeyValueStore() *KeyValueStore {
 	return &KeyValueStore{
 		m:        make(map[string]string),
@@ -38,12 +55,17 @@ func NewKeyValueStore() *KeyValueStore {
 }
 
 func (store *KeyValueStore) Delete(key string) error {
+	unlock := store.lockForWrite(key)
+	defer unlock()
+
+	if err := store.transact.WriteDelete(key); err != nil {
+		return err
+	}
+
 	store.Lock()
 	delete(store.m, key)
 	store.Unlock()
 
-	store.transact.WriteDelete(key)
-
 	return nil
 }
 
@@ -60,22 +82,66 @@ func (store *KeyValueStore) Get(key string) (string, error) {
 }
 
 func (store *KeyValueStore) Put(key string, value string) error {
+	unlock := store.lockForWrite(key)
+	defer unlock()
+
+	if err := store.transact.WritePut(key, value); err != nil {
+		return err
+	}
+
 	store.Lock()
 	store.m[key] = value
 	store.Unlock()
 
-	store.transact.WritePut(key, value)
-
 	return nil
 }
 
+// lockForWrite locks key for a write, and returns the function that
+// unlocks it.
+func (store *KeyValueStore) lockForWrite(key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	mu := &store.keyLocks[h.Sum32()%uint32(len(store.keyLocks))]
+
+	store.writes.RLock()
+	mu.Lock()
+
+	return func() {
+		mu.Unlock()
+		store.writes.RUnlock()
+	}
+}
+
 func (store *KeyValueStore) WithTransactionLogger(tl TransactionLogger) *KeyValueStore {
 	store.transact = tl
 	return store
 }
 
+// WithSnapshotInterval makes Restore start snapshotting the store every d,
+// if its TransactionLogger is a Snapshotter.
+func (store *KeyValueStore) WithSnapshotInterval(d time.Duration) *KeyValueStore {
+	store.snapshotInterval = d
+	return store
+}
+
+// Restore loads the latest snapshot, if the TransactionLogger supports
+// them and there is one, and replays the events that came after it.
 func (store *KeyValueStore) Restore() error {
 	var err error
+	var snapshot Snapshot
+
+	if s, isSnapshotter := store.transact.(Snapshotter); isSnapshotter {
+		snapshot, _, err = s.ReadSnapshot()
+		if err != nil {
+			return fmt.Errorf("failed to read snapshot: %w", err)
+		}
+	}
+
+	// Events are applied to the map directly, rather than with Put and
+	// Delete, so they aren't logged again.
+	store.Lock()
+	maps.Copy(store.m, snapshot.Data)
+	store.Unlock()
 
 	events, errors := store.transact.ReadEvents()
 	count, ok, e := 0, true, Event{}
@@ -85,18 +151,24 @@ func (store *KeyValueStore) Restore() error {
 		case err, ok = <-errors:
 
 		case e, ok = <-events:
+			if e.Sequence <= snapshot.Sequence {
+				continue // Already included in the snapshot
+			}
+
+			store.Lock()
 			switch e.EventType {
 			case EventDelete: // Got a DELETE event!
-				err = store.Delete(e.Key)
+				delete(store.m, e.Key)
 				count++
 			case EventPut: // Got a PUT event!
-				err = store.Put(e.Key, e.Value)
+				store.m[e.Key] = e.Value
 				count++
 			}
+			store.Unlock()
 		}
 	}
 
-	log.Printf("%d events replayed\n", count)
+	log.Printf("%d events replayed after snapshot at %d\n", count, snapshot.Sequence)
 
 	store.transact.Run()
 
@@ -106,13 +178,49 @@ func (store *KeyValueStore) Restore() error {
 		}
 	}()
 
+	if _, isSnapshotter := store.transact.(Snapshotter); isSnapshotter && store.snapshotInterval > 0 {
+		go func() {
+			for range time.Tick(store.snapshotInterval) {
+				if err := store.WriteSnapshot(); err != nil {
+					log.Print(err)
+				}
+			}
+		}()
+	}
+
 	return err
 }
 
+// WriteSnapshot snapshots the store, if its TransactionLogger supports it.
+// Writes are paused while the sequence is read and the store copied, so
+// every event up to the sequence has been applied to the store. Any that
+// are applied but not yet sequenced, as asynchronous writes can be, are
+// simply replayed again on restore.
+func (store *KeyValueStore) WriteSnapshot() error {
+	s, ok := store.transact.(Snapshotter)
+	if !ok {
+		return ErrorSnapshotsNotSupported
+	}
+
+	store.writes.Lock()
+	seq := store.transact.LastSequence()
+
+	store.RLock()
+	data := maps.Clone(store.m)
+	store.RUnlock()
+	store.writes.Unlock()
+
+	if err := s.WriteSnapshot(Snapshot{Sequence: seq, Data: data}); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	return nil
+}
+
 type ZeroTransactionLogger struct{}
 
-func (z ZeroTransactionLogger) WriteDelete(key string)                   {}
-func (z ZeroTransactionLogger) WritePut(key, value string)               {}
+func (z ZeroTransactionLogger) WriteDelete(key string) error             { return nil }
+func (z ZeroTransactionLogger) WritePut(key, value string) error         { return nil }
 func (z ZeroTransactionLogger) Err() <-chan error                        { return nil }
 func (z ZeroTransactionLogger) LastSequence() uint64                     { return 0 }
 func (z ZeroTransactionLogger) Run()                                     {}
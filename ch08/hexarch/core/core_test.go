@@ -18,6 +18,7 @@ package core
 
 import (
 	"errors"
+	"maps"
 	"testing"
 )
 
@@ -110,3 +111,115 @@ func TestDelete(t *testing.T) {
 		t.Error("Delete failed")
 	}
 }
+
+// snapshotLogger is a TransactionLogger and Snapshotter that holds its
+// events and snapshot in memory.
+type snapshotLogger struct {
+	ZeroTransactionLogger
+	events   []Event
+	snapshot Snapshot
+	written  []Event
+}
+
+func (l *snapshotLogger) WritePut(key, value string) error {
+	l.written = append(l.written, Event{EventType: EventPut, Key: key, Value: value})
+	return nil
+}
+
+func (l *snapshotLogger) LastSequence() uint64 {
+	return l.events[len(l.events)-1].Sequence
+}
+
+func (l *snapshotLogger) ReadEvents() (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error)
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		for _, e := range l.events {
+			outEvent <- e
+		}
+	}()
+
+	return outEvent, outError
+}
+
+func (l *snapshotLogger) WriteSnapshot(s Snapshot) error {
+	l.snapshot = s
+	return nil
+}
+
+func (l *snapshotLogger) ReadSnapshot() (Snapshot, bool, error) {
+	return l.snapshot, l.snapshot.Data != nil, nil
+}
+
+func TestRestoreFromSnapshot(t *testing.T) {
+	tl := &snapshotLogger{
+		snapshot: Snapshot{Sequence: 2, Data: map[string]string{"a": "1", "b": "2"}},
+		events: []Event{
+			{Sequence: 1, EventType: EventPut, Key: "a", Value: "stale"},
+			{Sequence: 2, EventType: EventPut, Key: "b", Value: "2"},
+			{Sequence: 3, EventType: EventDelete, Key: "a"},
+			{Sequence: 4, EventType: EventPut, Key: "c", Value: "3"},
+		},
+	}
+
+	store := NewKeyValueStore().WithTransactionLogger(tl)
+	if err := store.Restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"b": "2", "c": "3"}
+	if !maps.Equal(store.m, expected) {
+		t.Errorf("expected %v; got %v", expected, store.m)
+	}
+
+	if len(tl.written) != 0 {
+		t.Error("expected restore not to log events; got", tl.written)
+	}
+
+	store.Put("d", "4")
+
+	if err := store.WriteSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	if tl.snapshot.Sequence != 4 || tl.snapshot.Data["d"] != "4" {
+		t.Error("unexpected snapshot:", tl.snapshot)
+	}
+}
+
+// failingLogger is a TransactionLogger whose writes always fail.
+type failingLogger struct {
+	ZeroTransactionLogger
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (failingLogger) WritePut(key, value string) error { return errWriteFailed }
+func (failingLogger) WriteDelete(key string) error     { return errWriteFailed }
+
+func TestWriteErrorsReturned(t *testing.T) {
+	store := NewKeyValueStore().WithTransactionLogger(failingLogger{})
+
+	if err := store.Put("a", "1"); !errors.Is(err, errWriteFailed) {
+		t.Error("expected a write error from Put; got", err)
+	}
+
+	// A write that fails to log isn't applied.
+	if _, err := store.Get("a"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Error("expected the failed Put not to be applied; got", err)
+	}
+
+	store.m["b"] = "2"
+
+	if err := store.Delete("b"); !errors.Is(err, errWriteFailed) {
+		t.Error("expected a write error from Delete; got", err)
+	}
+
+	if _, err := store.Get("b"); err != nil {
+		t.Error("expected the failed Delete not to be applied; got", err)
+	}
+}
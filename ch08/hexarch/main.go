@@ -18,6 +18,7 @@ package main
 
 import (
 	"log"
+	"time"
 
 	"github.com/cloud-native-go/examples/ch08/hexarch/core"
 	"github.com/cloud-native-go/examples/ch08/hexarch/frontend"
@@ -31,7 +32,9 @@ func main() {
 
 	// Create Core and tell it which TransactionLogger to use.
 	// This is an example of a "driven agent"
-	store := core.NewKeyValueStore().WithTransactionLogger(tl)
+	store := core.NewKeyValueStore().
+		WithTransactionLogger(tl).
+		WithSnapshotInterval(10 * time.Minute)
 	store.Restore()
 
 	// Create the frontend.
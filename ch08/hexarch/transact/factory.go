@@ -28,7 +28,10 @@ func NewTransactionLogger(s string) (core.TransactionLogger, error) {
 		return NewTestTransactionLogger()
 
 	case "file":
-		return NewFileTransactionLogger("./transactions.txt")
+		return NewFileTransactionLoggerWithOptions("./transactions.txt", FileLoggerOptions{
+			Durability:     DurabilityGroupCommit,
+			MaxSegmentSize: 4 << 20,
+		})
 
 	case "postgres":
 		params := PostgresDbParams{
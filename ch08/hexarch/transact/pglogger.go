@@ -40,16 +40,18 @@ type PostgresTransactionLogger struct {
 	wg     *sync.WaitGroup   // Used to ensure writes are completed
 }
 
-func (l *PostgresTransactionLogger) WritePut(key, value string) {
+func (l *PostgresTransactionLogger) WritePut(key, value string) error {
 	l.wg.Add(1)
 	l.events <- core.Event{EventType: core.EventPut, Key: key, Value: url.QueryEscape(value)}
 	l.wg.Done()
+	return nil
 }
 
-func (l *PostgresTransactionLogger) WriteDelete(key string) {
+func (l *PostgresTransactionLogger) WriteDelete(key string) error {
 	l.wg.Add(1)
 	l.events <- core.Event{EventType: core.EventDelete, Key: key}
 	l.wg.Done()
+	return nil
 }
 
 func (l *PostgresTransactionLogger) Err() <-chan error {
@@ -0,0 +1,341 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transact
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A log is made up of the active segment, which is the file named by the
+// log's filename and is the only one written to, and any number of closed
+// segments. When the active segment rolls over it's renamed to filename
+// followed by a dot and its segment number, such as "transactions.txt.000001",
+// and a new active segment is started. Closed segments have the same format
+// as the active one.
+//
+// The sequence range of each closed segment is kept in an index file, so
+// that the log can be opened without reading every segment. The index is
+// only a cache: a segment missing from it, as happens if the process dies
+// while rolling over, is scanned when the log is opened. The index file
+// starts with an 8-byte header like a log's, but with the magic string
+// "KVSI", and is followed by:
+//
+//	count    uvarint  The number of segments
+//	segments:
+//	  number uvarint
+//	  first  uvarint  The segment's first sequence number
+//	  last   uvarint  The segment's last sequence number
+//	checksum uint32   CRC-32C of everything before it, little-endian
+
+const indexMagic = "KVSI"
+
+// segment describes a closed segment.
+type segment struct {
+	number      int
+	first, last uint64
+}
+
+// segmentFilename returns the name of closed segment number n of the log
+// file called filename.
+func segmentFilename(filename string, n int) string {
+	return fmt.Sprintf("%s.%06d", filename, n)
+}
+
+// indexFilename returns the name of the segment index file for the log
+// file called filename.
+func indexFilename(filename string) string {
+	return filename + ".index"
+}
+
+func encodeIndex(segments []segment) []byte {
+	buf := make([]byte, logHeaderSize)
+	copy(buf, indexMagic)
+	buf[len(indexMagic)] = logVersion
+
+	buf = binary.AppendUvarint(buf, uint64(len(segments)))
+
+	for _, s := range segments {
+		buf = binary.AppendUvarint(buf, uint64(s.number))
+		buf = binary.AppendUvarint(buf, s.first)
+		buf = binary.AppendUvarint(buf, s.last)
+	}
+
+	return binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+}
+
+func decodeIndex(data []byte) ([]segment, error) {
+	if len(data) < logHeaderSize+4 || string(data[:len(indexMagic)]) != indexMagic {
+		return nil, fmt.Errorf("%w: bad segment index header", ErrorCorruptLog)
+	}
+
+	if v := data[len(indexMagic)]; v != logVersion {
+		return nil, fmt.Errorf("%w: segment index version %d", ErrorUnsupportedVersion, v)
+	}
+
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return nil, fmt.Errorf("%w: segment index checksum mismatch", ErrorCorruptLog)
+	}
+
+	p := body[logHeaderSize:]
+	bad := fmt.Errorf("%w: bad segment index body", ErrorCorruptLog)
+
+	count, n := binary.Uvarint(p)
+	if n <= 0 {
+		return nil, bad
+	}
+	p = p[n:]
+
+	segments := make([]segment, 0, min(count, uint64(len(p))))
+
+	for i := uint64(0); i < count; i++ {
+		var fields [3]uint64
+		for j := range fields {
+			if fields[j], n = binary.Uvarint(p); n <= 0 {
+				return nil, bad
+			}
+			p = p[n:]
+		}
+		segments = append(segments, segment{number: int(fields[0]), first: fields[1], last: fields[2]})
+	}
+
+	return segments, nil
+}
+
+// loadSegments returns the closed segments of the log file called
+// filename, in order. It takes their ranges from the index where it can,
+// scans those the index is missing, and rewrites the index if it was out
+// of date.
+func loadSegments(filename string) ([]segment, error) {
+	numbers, err := segmentNumbers(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// A missing or damaged index is rebuilt from the segments themselves.
+	var indexed []segment
+	data, err := os.ReadFile(indexFilename(filename))
+	switch {
+	case err == nil:
+		indexed, _ = decodeIndex(data)
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("cannot read segment index file: %w", err)
+	}
+
+	var segments []segment
+	stale := len(indexed) != len(numbers)
+
+	for _, n := range numbers {
+		i := slices.IndexFunc(indexed, func(s segment) bool { return s.number == n })
+		if i >= 0 {
+			segments = append(segments, indexed[i])
+			continue
+		}
+
+		first, last, err := scanSegment(segmentFilename(filename, n))
+		if err != nil {
+			return nil, err
+		}
+
+		segments = append(segments, segment{number: n, first: first, last: last})
+		stale = true
+	}
+
+	if stale {
+		if err := replaceFile(indexFilename(filename), encodeIndex(segments)); err != nil {
+			return nil, fmt.Errorf("cannot write segment index file: %w", err)
+		}
+	}
+
+	return segments, nil
+}
+
+// segmentNumbers returns the numbers of the closed segments of the log
+// file called filename, in ascending order.
+func segmentNumbers(filename string) ([]int, error) {
+	entries, err := os.ReadDir(filepath.Dir(filename))
+	if err != nil {
+		return nil, fmt.Errorf("cannot list transaction log segments: %w", err)
+	}
+
+	prefix := filepath.Base(filename) + "."
+
+	var numbers []int
+	for _, entry := range entries {
+		suffix, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || len(suffix) < 6 {
+			continue
+		}
+
+		if n, err := strconv.Atoi(suffix); err == nil && n > 0 {
+			numbers = append(numbers, n)
+		}
+	}
+
+	slices.Sort(numbers)
+
+	return numbers, nil
+}
+
+// scanSegment returns the first and last sequence numbers of the closed
+// segment called name.
+func scanSegment(name string) (first, last uint64, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot open transaction log segment: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot stat transaction log segment: %w", err)
+	}
+
+	header := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, 0, fmt.Errorf("%w: segment %s: %w", ErrorCorruptLog, name, err)
+	}
+	if err := checkLogHeader(header); err != nil {
+		return 0, 0, err
+	}
+
+	size := info.Size() - logHeaderSize
+
+	_, first, last, err = scanLog(f, size)
+	if err != nil {
+		return 0, 0, fmt.Errorf("segment %s: %w", name, err)
+	}
+
+	return first, last, nil
+}
+
+// dueToRoll reports whether the active segment should be rolled over
+// before n more bytes are written to it. An empty segment never is.
+// Must be called with l.mu held.
+func (l *FileTransactionLogger) dueToRoll(n int) bool {
+	if l.last == 0 {
+		return false
+	}
+
+	if l.opts.MaxSegmentSize > 0 && l.size+int64(n) > l.opts.MaxSegmentSize {
+		return true
+	}
+
+	return l.opts.MaxSegmentAge > 0 && time.Since(l.started) >= l.opts.MaxSegmentAge
+}
+
+// roll closes the active segment, renaming it to the next segment number,
+// and starts a new one. The new segment is created under a temporary name
+// first, so that a failure leaves the log as it was. Must be called with
+// l.mu held.
+func (l *FileTransactionLogger) roll() error {
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("cannot sync log file: %w", err)
+	}
+
+	n := 1
+	if len(l.segments) > 0 {
+		n = l.segments[len(l.segments)-1].number + 1
+	}
+
+	name, next := segmentFilename(l.filename, n), l.filename+".next"
+
+	if err := writeFileSync(next, logHeader()); err != nil {
+		os.Remove(next)
+		return fmt.Errorf("cannot roll over transaction log: %w", err)
+	}
+
+	file, err := openLogFile(next)
+	if err != nil {
+		os.Remove(next)
+		return err
+	}
+
+	if err := os.Rename(l.filename, name); err != nil {
+		file.Close()
+		os.Remove(next)
+		return fmt.Errorf("cannot roll over transaction log: %w", err)
+	}
+
+	if err := os.Rename(next, l.filename); err != nil {
+		os.Rename(name, l.filename)
+		file.Close()
+		os.Remove(next)
+		return fmt.Errorf("cannot roll over transaction log: %w", err)
+	}
+
+	// The renames are done, so the switch to the new segment is finished
+	// even if they can't be synced.
+	l.file.Close()
+	l.file = file
+
+	l.segments = append(l.segments, segment{number: n, first: l.first, last: l.last})
+	l.size, l.first, l.last = logHeaderSize, 0, 0
+	l.started = time.Now()
+
+	syncErr := syncDir(l.filename)
+
+	// The index is only a cache, so failing to update it isn't an error:
+	// the new segment is scanned when the log is next opened.
+	replaceFile(indexFilename(l.filename), encodeIndex(l.segments))
+
+	if syncErr != nil {
+		return fmt.Errorf("cannot roll over transaction log: %w", syncErr)
+	}
+
+	return nil
+}
+
+// removeSegments removes the closed segments that the latest snapshot
+// includes entirely. Must be called with l.mu held.
+func (l *FileTransactionLogger) removeSegments() error {
+	i := 0
+	for i < len(l.segments) && l.segments[i].last <= l.snapshotSequence {
+		i++
+	}
+
+	if i == 0 {
+		return nil
+	}
+
+	removed := l.segments[:i]
+	l.segments = slices.Clone(l.segments[i:])
+
+	// Update the index first, so that it never names a removed segment.
+	if err := replaceFile(indexFilename(l.filename), encodeIndex(l.segments)); err != nil {
+		return fmt.Errorf("cannot write segment index file: %w", err)
+	}
+
+	for _, s := range removed {
+		err := os.Remove(segmentFilename(l.filename, s.number))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("cannot remove transaction log segment: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transact
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cloud-native-go/examples/ch08/hexarch/core"
+)
+
+// A snapshot file starts with an 8-byte header like a log's, but with the
+// magic string "KVSS". It's followed by:
+//
+//	sequence    uvarint  The last event the snapshot includes
+//	count       uvarint  The number of entries
+//	entries:
+//	  key length uvarint, followed by the key
+//	  value length uvarint, followed by the value
+//	checksum    uint32   CRC-32C of everything before it, little-endian
+
+const snapshotMagic = "KVSS"
+
+// snapshotFilename returns the name of the snapshot file for the log file
+// called filename.
+func snapshotFilename(filename string) string {
+	return filename + ".snapshot"
+}
+
+func encodeSnapshot(s core.Snapshot) []byte {
+	buf := make([]byte, logHeaderSize)
+	copy(buf, snapshotMagic)
+	buf[len(snapshotMagic)] = logVersion
+
+	buf = binary.AppendUvarint(buf, s.Sequence)
+	buf = binary.AppendUvarint(buf, uint64(len(s.Data)))
+
+	for k, v := range s.Data {
+		buf = binary.AppendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		buf = append(buf, v...)
+	}
+
+	return binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+}
+
+func decodeSnapshot(data []byte) (core.Snapshot, error) {
+	var s core.Snapshot
+
+	if len(data) < logHeaderSize+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return s, fmt.Errorf("%w: bad snapshot header", ErrorCorruptLog)
+	}
+
+	if v := data[len(snapshotMagic)]; v != logVersion {
+		return s, fmt.Errorf("%w: snapshot version %d", ErrorUnsupportedVersion, v)
+	}
+
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return s, fmt.Errorf("%w: snapshot checksum mismatch", ErrorCorruptLog)
+	}
+
+	p := body[logHeaderSize:]
+	bad := fmt.Errorf("%w: bad snapshot body", ErrorCorruptLog)
+
+	var n int
+	if s.Sequence, n = binary.Uvarint(p); n <= 0 {
+		return s, bad
+	}
+	p = p[n:]
+
+	count, n := binary.Uvarint(p)
+	if n <= 0 {
+		return s, bad
+	}
+	p = p[n:]
+
+	s.Data = make(map[string]string, min(count, uint64(len(p))))
+
+	for i := uint64(0); i < count; i++ {
+		var kv [2]string
+		for j := range kv {
+			length, n := binary.Uvarint(p)
+			if n <= 0 || uint64(len(p)-n) < length {
+				return s, bad
+			}
+			kv[j], p = string(p[n:n+int(length)]), p[n+int(length):]
+		}
+		s.Data[kv[0]] = kv[1]
+	}
+
+	return s, nil
+}
+
+// readSnapshot reads the snapshot file called name. ok is false if it
+// doesn't exist.
+func readSnapshot(name string) (s core.Snapshot, ok bool, err error) {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, false, nil
+	}
+	if err != nil {
+		return s, false, fmt.Errorf("cannot read snapshot file: %w", err)
+	}
+
+	s, err = decodeSnapshot(data)
+	if err != nil {
+		return s, false, err
+	}
+
+	return s, true, nil
+}
+
+// readSnapshotSequence returns the sequence of the snapshot file called
+// name, or 0 if it doesn't exist, without reading the whole file.
+func readSnapshotSequence(name string) (uint64, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot read snapshot file: %w", err)
+	}
+	defer f.Close()
+
+	header := make([]byte, logHeaderSize+binary.MaxVarintLen64)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, fmt.Errorf("cannot read snapshot file: %w", err)
+	}
+
+	if n < logHeaderSize || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, fmt.Errorf("%w: bad snapshot header", ErrorCorruptLog)
+	}
+
+	seq, m := binary.Uvarint(header[logHeaderSize:n])
+	if m <= 0 {
+		return 0, fmt.Errorf("%w: bad snapshot body", ErrorCorruptLog)
+	}
+
+	return seq, nil
+}
+
+// replaceFile atomically replaces the file called name with one containing
+// data, syncing both the file and its directory, so that after a crash
+// there's either the old file or the new one.
+func replaceFile(name string, data []byte) error {
+	tmp := name + ".tmp"
+
+	if err := writeFileSync(tmp, data); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(name)
+}
+
+// syncDir syncs the directory containing the file called name, so that a
+// file's creation, renaming or removal survives a crash.
+func syncDir(name string) error {
+	dir, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// writeFileSync writes data to a new file called name, and syncs it to
+// disk.
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -27,12 +27,14 @@ type TestTransactionLogger struct {
 	sequence uint64
 }
 
-func (l *TestTransactionLogger) WritePut(key, value string) {
+func (l *TestTransactionLogger) WritePut(key, value string) error {
 	l.events <- core.Event{EventType: core.EventPut, Key: key, Value: value}
+	return nil
 }
 
-func (l *TestTransactionLogger) WriteDelete(key string) {
+func (l *TestTransactionLogger) WriteDelete(key string) error {
 	l.events <- core.Event{EventType: core.EventDelete, Key: key}
+	return nil
 }
 
 func (l *TestTransactionLogger) Err() <-chan error {
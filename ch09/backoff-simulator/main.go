@@ -21,6 +21,8 @@ import (
 	"fmt"
 	"math/rand"
 	"time"
+
+	"github.com/cloud-native-go/examples/ch04"
 )
 
 // Number of concurrently requesting instances
@@ -102,53 +104,44 @@ func withNoBackoff() string {
 
 // Using withDelayedBackoff as the backoff function sends retries after a
 // two-second delay.
-func withDelayedBackoff() string {
-	res, err := sendRequest()
-	for err != nil {
-		time.Sleep(2000 * time.Millisecond)
-		res, err = sendRequest()
-	}
-
-	return res
-}
+var withDelayedBackoff = withBackoff(ch04.ConstantBackoff(2 * time.Second))
 
 // Using withExponentialBackoff as the backoff function sends retries
 // initially with a 1-second delay, but doubling after each attempt to
 // a maximum delay of 1-minute.
-func withExponentialBackoff() string {
-	res, err := sendRequest()
-	base, cap := time.Second, time.Minute
-
-	for backoff := base; err != nil; backoff <<= 1 {
-		if backoff > cap {
-			backoff = cap
-		}
-		time.Sleep(backoff)
-		res, err = sendRequest()
-	}
-
-	return res
-}
-
-// Using withExponentialBackoff as the backoff function sends retries
-// initially with a 1-second delay, but doubling after each attempt to
-// a maximum delay of 1-minute. Each backoff time gets an additional
-func withExponentialBackoffAndJitter() string {
-	res, err := sendRequest()
-	base, cap := time.Second, time.Minute
-
-	for backoff := base; err != nil; backoff <<= 1 {
-		if backoff > cap {
-			backoff = cap
+var withExponentialBackoff = withBackoff(ch04.ExponentialBackoff(time.Second, time.Minute))
+
+// Using withExponentialBackoffAndJitter as the backoff function sends
+// retries after a random delay between zero and the delay that
+// withExponentialBackoff would use.
+var withExponentialBackoffAndJitter = withBackoff(ch04.FullJitterBackoff(time.Second, time.Minute))
+
+// Using withEqualJitter as the backoff function sends retries after half
+// the delay that withExponentialBackoff would use, plus a random duration
+// up to the other half.
+var withEqualJitter = withBackoff(ch04.EqualJitterBackoff(time.Second, time.Minute))
+
+// Using withDecorrelatedJitter as the backoff function sends retries after
+// a random delay between 1 second and three times the previous delay, to a
+// maximum delay of 1-minute.
+var withDecorrelatedJitter = withBackoff(ch04.DecorrelatedJitterBackoff(time.Second, time.Minute))
+
+// withBackoff returns a backoff function that retries sendRequest until
+// it succeeds, waiting between attempts for as long as backoff says. The
+// strategies are the same ones that ch04.RetryWithOptions uses.
+func withBackoff(backoff ch04.Backoff) func() string {
+	return func() string {
+		var delay time.Duration
+
+		res, err := sendRequest()
+		for attempt := 1; err != nil; attempt++ {
+			delay = backoff(attempt, delay)
+			time.Sleep(delay)
+			res, err = sendRequest()
 		}
 
-		jitter := rand.Int63n(int64(backoff * 3))
-		sleep := base + time.Duration(jitter)
-		time.Sleep(sleep)
-		res, err = sendRequest()
+		return res
 	}
-
-	return res
 }
 
 // sendRequest simulates sending a request. It always returns an